@@ -5,8 +5,10 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -29,6 +31,71 @@ type SSHPrometheusSettings struct {
 	SSHPort     int    `json:"-"` // Parsed manually to handle string/int
 	SSHUsername string `json:"sshUsername"`
 	AuthMethod  string `json:"authMethod"`
+	AgentSocket string `json:"agentSocket"`
+
+	// Hours before SSH certificate expiry at which health checks warn
+	SSHCertExpiryWarningHours int `json:"sshCertExpiryWarningHours"`
+
+	// Expose Prometheus on a local 127.0.0.1 port instead of dialing
+	// through the SSH connection directly
+	LocalListener bool `json:"localListener"`
+
+	// How connections reach Prometheus: "auto", "forward" or "exec", and the
+	// relay command run by the exec transport
+	Transport   string `json:"transport"`
+	ExecCommand string `json:"execCommand"`
+
+	// SSH keepalive supervisor
+	KeepaliveInterval  int `json:"keepaliveInterval"` // seconds
+	KeepaliveMaxMisses int `json:"keepaliveMaxMisses"`
+
+	// Close the tunnel after this many seconds without traffic, 0 keeps it
+	// open; the next request re-establishes it
+	IdleTimeout int `json:"idleTimeout"`
+
+	// Seconds in-flight requests may take to finish when the datasource is
+	// disposed, e.g. after its settings were saved; negative closes at once
+	DrainTimeout int `json:"drainTimeout"`
+
+	// Regular expressions recognising keyboard-interactive prompts
+	PasswordPromptPattern string `json:"passwordPromptPattern"`
+	OTPPromptPattern      string `json:"otpPromptPattern"`
+
+	// Certificates minted by the built-in SSH CA ("ca" auth method)
+	CACertTTL             int               `json:"caCertTtl"` // seconds
+	CACertPrincipals      []string          `json:"caCertPrincipals"`
+	CACertCriticalOptions map[string]string `json:"caCertCriticalOptions"`
+	CACertExtensions      []string          `json:"caCertExtensions"`
+
+	// Alternative SSH host endpoints ("host" or "host:port") and how to
+	// choose between them: "failover", "random" or "latency"
+	SSHHosts        []string `json:"sshHosts"`
+	SSHHostStrategy string   `json:"sshHostStrategy"`
+	SSHHostCooldown int      `json:"sshHostCooldown"` // seconds
+
+	// SSH Host Key Verification
+	HostKeyPolicy      string `json:"hostKeyPolicy"`
+	HostKeyFingerprint string `json:"hostKeyFingerprint"`
+
+	// SSH algorithm policy: a preset ("modern", "fips" or "legacy") and
+	// allow-lists in preference order that override it, applied to every hop
+	SSHAlgorithmPreset   string   `json:"sshAlgorithmPreset"`
+	SSHKeyExchanges      []string `json:"sshKeyExchanges"`
+	SSHCiphers           []string `json:"sshCiphers"`
+	SSHMACs              []string `json:"sshMacs"`
+	SSHHostKeyAlgorithms []string `json:"sshHostKeyAlgorithms"`
+
+	// SOCKS5 or HTTP CONNECT proxy used to reach the first SSH hop
+	ProxyType     string `json:"proxyType"`
+	ProxyAddress  string `json:"proxyAddress"`
+	ProxyUsername string `json:"proxyUsername"`
+
+	// Jump hosts dialed in order before SSHHost (ProxyJump)
+	JumpHosts []JumpHostSettings `json:"jumpHosts"`
+
+	// Further services behind the SSH host, reachable through resource
+	// calls prefixed with their name
+	Targets []TargetSettings `json:"targets"`
 
 	// Prometheus Connection
 	PrometheusURL string `json:"prometheusUrl"`
@@ -38,22 +105,50 @@ type SSHPrometheusSettings struct {
 	PrometheusUsername   string `json:"prometheusUsername"`
 
 	// TLS Settings
-	TLSSkipVerify    bool `json:"tlsSkipVerify"`
-	TLSWithCACert    bool `json:"tlsWithCACert"`
+	TLSSkipVerify     bool `json:"tlsSkipVerify"`
+	TLSWithCACert     bool `json:"tlsWithCACert"`
 	TLSWithClientCert bool `json:"tlsWithClientCert"`
 
 	// HTTP Settings
 	HTTPMethod            string `json:"httpMethod"`
 	CustomQueryParameters string `json:"customQueryParameters"`
 	Timeout               int    `json:"timeout"`
+
+	// Queries fail when a Prometheus response exceeds this many megabytes,
+	// 0 is unlimited
+	MaxResponseSize int `json:"maxResponseSize"`
+}
+
+// JumpHostSettings configures one bastion in front of the SSH host. Its
+// secrets live in secure JSON, see jumpHostConfig.
+type JumpHostSettings struct {
+	Host               string `json:"host"`
+	Port               int    `json:"port"`
+	Username           string `json:"username"`
+	AuthMethod         string `json:"authMethod"`
+	AgentSocket        string `json:"agentSocket"`
+	HostKeyPolicy      string `json:"hostKeyPolicy"`
+	HostKeyFingerprint string `json:"hostKeyFingerprint"`
+}
+
+// TargetSettings names a service behind the SSH host, such as Alertmanager.
+// Its URL is interpreted like the Prometheus URL, but an HTTP path is kept as
+// path prefix.
+type TargetSettings struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
 }
 
 type Datasource struct {
+	uid        string
 	settings   SSHPrometheusSettings
 	secureData map[string]string
 	tunnel     *ssh.Tunnel
 	tunnelMu   sync.Mutex
+	connecting *connectAttempt
+	disposed   bool
 	httpClient *http.Client
+	targets    map[string]*forwardTarget
 }
 
 func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
@@ -93,6 +188,12 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 	if jsonData.PrometheusAuthMethod == "" {
 		jsonData.PrometheusAuthMethod = "none"
 	}
+	if jsonData.SSHCertExpiryWarningHours == 0 {
+		jsonData.SSHCertExpiryWarningHours = 24
+	}
+	if jsonData.DrainTimeout == 0 {
+		jsonData.DrainTimeout = 10
+	}
 
 	secureData := settings.DecryptedSecureJSONData
 
@@ -103,19 +204,40 @@ func NewDatasource(ctx context.Context, settings backend.DataSourceInstanceSetti
 	}
 
 	ds := &Datasource{
+		uid:        settings.UID,
 		settings:   jsonData,
 		secureData: secureData,
-		httpClient: &http.Client{
-			Timeout: time.Duration(jsonData.Timeout) * time.Second,
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-			},
-		},
 	}
 
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		IdleConnTimeout: ds.idleConnTimeout(),
+	}
+	if !jsonData.LocalListener {
+		// Connections go straight into the SSH tunnel, nothing listens locally.
+		transport.DialContext = ds.dialTunnel
+	}
+	ds.httpClient = &http.Client{
+		Timeout:   time.Duration(jsonData.Timeout) * time.Second,
+		Transport: transport,
+	}
+
+	ds.targets, err = ds.newForwardTargets(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	retainMetrics(ds.uid)
 	return ds, nil
 }
 
+// idleConnTimeout returns how long kept-alive HTTP connections stay open.
+// Each of them is an SSH channel, and a tunnel with open channels is never
+// idle, so they are closed well before the tunnel's idle timeout.
+func (d *Datasource) idleConnTimeout() time.Duration {
+	return time.Duration(d.settings.IdleTimeout) * time.Second / 2
+}
+
 func createTLSConfig(settings SSHPrometheusSettings, secureData map[string]string) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: settings.TLSSkipVerify,
@@ -149,76 +271,382 @@ func createTLSConfig(settings SSHPrometheusSettings, secureData map[string]strin
 	return tlsConfig, nil
 }
 
+// Dispose closes the tunnel, which releases this instance's reference to the
+// pooled SSH connection rather than closing it. Requests in flight get the
+// configured drain timeout to finish.
 func (d *Datasource) Dispose() {
 	d.tunnelMu.Lock()
-	defer d.tunnelMu.Unlock()
+	disposed := d.disposed
+	d.disposed = true
+	if d.connecting != nil {
+		d.connecting.cancel()
+	}
+	tunnel := d.tunnel
+	d.tunnel = nil
+	d.tunnelMu.Unlock()
+
+	if tunnel != nil {
+		// Idle kept-alive connections would otherwise hold up the drain.
+		done := make(chan struct{})
+		go d.closeIdleConnectionsUntil(done)
+		tunnel.Close()
+		close(done)
+	}
+	if !disposed {
+		releaseMetrics(d.uid)
+	}
+}
 
-	if d.tunnel != nil {
-		d.tunnel.Close()
-		d.tunnel = nil
+// tunnelConfig builds the SSH part of the tunnel configuration from the
+// datasource settings and decrypted secrets.
+func (d *Datasource) tunnelConfig() ssh.TunnelConfig {
+	config := ssh.TunnelConfig{
+		HopConfig: ssh.HopConfig{
+			SSHHost:            d.settings.SSHHost,
+			SSHPort:            d.settings.SSHPort,
+			SSHUsername:        d.settings.SSHUsername,
+			AuthMethod:         d.settings.AuthMethod,
+			AgentSocket:        d.settings.AgentSocket,
+			HostKeyPolicy:      d.settings.HostKeyPolicy,
+			HostKeyFingerprint: d.settings.HostKeyFingerprint,
+			KnownHosts:         d.secureData["sshKnownHosts"],
+			Algorithms:         d.algorithmPolicy(),
+		},
+		DatasourceUID: d.uid,
+	}
+
+	config.OTPSecret = d.secureData["sshOTPSecret"]
+	config.PromptRules = d.promptRules()
+
+	switch d.settings.AuthMethod {
+	case "password", "keyboard-interactive":
+		config.SSHPassword = d.secureData["sshPassword"]
+	case "ca":
+		config.CAPrivateKey = d.secureData["sshCAPrivateKey"]
+		config.CAKeyPassphrase = d.secureData["sshCAKeyPassphrase"]
+		config.CertOptions = d.certOptions()
+	default:
+		config.SSHPrivateKey = d.secureData["sshPrivateKey"]
+		config.SSHKeyPassphrase = d.secureData["sshKeyPassphrase"]
+		config.SSHCertificate = d.secureData["sshCertificate"]
+	}
+
+	// A second keyboard-interactive factor may ask for the password too.
+	if config.OTPSecret != "" && config.SSHPassword == "" {
+		config.SSHPassword = d.secureData["sshPassword"]
+	}
+
+	for _, host := range d.settings.SSHHosts {
+		config.Endpoints = append(config.Endpoints, parseEndpoint(host))
+	}
+	config.Strategy = d.settings.SSHHostStrategy
+	config.Cooldown = time.Duration(d.settings.SSHHostCooldown) * time.Second
+
+	if d.settings.ProxyType != "" {
+		config.Proxy = ssh.ProxyConfig{
+			Type:     d.settings.ProxyType,
+			Address:  d.settings.ProxyAddress,
+			Username: d.settings.ProxyUsername,
+			Password: d.secureData["proxyPassword"],
+		}
+	}
+
+	for i, jh := range d.settings.JumpHosts {
+		config.JumpHosts = append(config.JumpHosts, d.jumpHostConfig(i, jh))
+	}
+
+	return config
+}
+
+// parseEndpoint parses an SSH host endpoint given as "host" or "host:port".
+// A missing port is filled in with the SSH port by the tunnel.
+func parseEndpoint(hostPort string) ssh.Endpoint {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return ssh.Endpoint{Host: hostPort}
+	}
+	port, _ := strconv.Atoi(portStr)
+	return ssh.Endpoint{Host: host, Port: port}
+}
+
+// jumpHostConfig builds the hop configuration of the i-th jump host. Jump
+// host secrets are stored in secure JSON under keys prefixed with
+// "jumpHost<i>", e.g. "jumpHost0Password".
+func (d *Datasource) jumpHostConfig(i int, jh JumpHostSettings) ssh.HopConfig {
+	secret := func(name string) string {
+		return d.secureData[fmt.Sprintf("jumpHost%d%s", i, name)]
+	}
+
+	hop := ssh.HopConfig{
+		SSHHost:            jh.Host,
+		SSHPort:            jh.Port,
+		SSHUsername:        jh.Username,
+		AuthMethod:         jh.AuthMethod,
+		AgentSocket:        jh.AgentSocket,
+		HostKeyPolicy:      jh.HostKeyPolicy,
+		HostKeyFingerprint: jh.HostKeyFingerprint,
+		KnownHosts:         secret("KnownHosts"),
+		Algorithms:         d.algorithmPolicy(),
+	}
+	if hop.SSHPort == 0 {
+		hop.SSHPort = 22
+	}
+
+	hop.OTPSecret = secret("OTPSecret")
+	hop.PromptRules = d.promptRules()
+
+	switch jh.AuthMethod {
+	case "password", "keyboard-interactive":
+		hop.SSHPassword = secret("Password")
+	case "ca":
+		hop.CAPrivateKey = d.secureData["sshCAPrivateKey"]
+		hop.CAKeyPassphrase = d.secureData["sshCAKeyPassphrase"]
+		hop.CertOptions = d.certOptions()
+	default:
+		hop.SSHPrivateKey = secret("PrivateKey")
+		hop.SSHKeyPassphrase = secret("KeyPassphrase")
+		hop.SSHCertificate = secret("Certificate")
+	}
+
+	if hop.OTPSecret != "" && hop.SSHPassword == "" {
+		hop.SSHPassword = secret("Password")
+	}
+
+	return hop
+}
+
+func (d *Datasource) promptRules() ssh.PromptRules {
+	return ssh.PromptRules{
+		Password: d.settings.PasswordPromptPattern,
+		OTP:      d.settings.OTPPromptPattern,
 	}
 }
 
+// algorithmPolicy restricts the SSH algorithms of every hop.
+func (d *Datasource) algorithmPolicy() ssh.AlgorithmPolicy {
+	return ssh.AlgorithmPolicy{
+		Preset:       d.settings.SSHAlgorithmPreset,
+		KeyExchanges: d.settings.SSHKeyExchanges,
+		Ciphers:      d.settings.SSHCiphers,
+		MACs:         d.settings.SSHMACs,
+		HostKeys:     d.settings.SSHHostKeyAlgorithms,
+	}
+}
+
+// certOptions configures the certificates minted by the built-in SSH CA.
+// The datasource has a single CA that is shared by every hop using it.
+func (d *Datasource) certOptions() ssh.CertOptions {
+	return ssh.CertOptions{
+		TTL:             time.Duration(d.settings.CACertTTL) * time.Second,
+		Principals:      d.settings.CACertPrincipals,
+		CriticalOptions: d.settings.CACertCriticalOptions,
+		Extensions:      d.settings.CACertExtensions,
+	}
+}
+
+// ensureTunnel returns once the tunnel is established or ctx is done.
+// Concurrent callers share a single connect attempt, which is cancelled when
+// all of them have given up.
 func (d *Datasource) ensureTunnel(ctx context.Context) error {
 	d.tunnelMu.Lock()
-	defer d.tunnelMu.Unlock()
 
+	// A lost connection is re-established in the background by the tunnel's
+	// supervisor; until then requests fail fast.
 	if d.tunnel != nil && d.tunnel.IsAlive() {
-		return nil
+		defer d.tunnelMu.Unlock()
+		return d.tunnel.Ready()
 	}
 
 	if d.tunnel != nil {
 		d.tunnel.Close()
 		d.tunnel = nil
+		// Kept-alive HTTP connections were channels of the closed tunnel.
+		d.closeIdleConnections()
 	}
 
-	config := ssh.TunnelConfig{
-		SSHHost:     d.settings.SSHHost,
-		SSHPort:     d.settings.SSHPort,
-		SSHUsername: d.settings.SSHUsername,
-		AuthMethod:  d.settings.AuthMethod,
+	attempt := d.connecting
+	if attempt == nil {
+		config, err := d.prometheusTunnelConfig()
+		if err != nil {
+			d.tunnelMu.Unlock()
+			return err
+		}
+		connectCtx, cancel := context.WithCancel(context.Background())
+		attempt = &connectAttempt{done: make(chan struct{}), cancel: cancel}
+		d.connecting = attempt
+		go d.connect(connectCtx, attempt, config)
 	}
-
-	if d.settings.AuthMethod == "password" {
-		config.SSHPassword = d.secureData["sshPassword"]
-	} else {
-		config.SSHPrivateKey = d.secureData["sshPrivateKey"]
-		config.SSHKeyPassphrase = d.secureData["sshKeyPassphrase"]
+	attempt.waiters++
+	d.tunnelMu.Unlock()
+
+	select {
+	case <-attempt.done:
+		return attempt.err
+	case <-ctx.Done():
+		d.tunnelMu.Lock()
+		attempt.waiters--
+		if attempt.waiters == 0 {
+			attempt.cancel()
+			if d.connecting == attempt {
+				d.connecting = nil
+			}
+		}
+		d.tunnelMu.Unlock()
+		return ctx.Err()
 	}
+}
+
+// connectAttempt is an in-flight tunnel connect shared by every request
+// waiting for it.
+type connectAttempt struct {
+	done    chan struct{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// connect establishes the tunnel for attempt without holding tunnelMu, so
+// requests that do not need a new tunnel are not blocked by a slow bastion.
+func (d *Datasource) connect(ctx context.Context, attempt *connectAttempt, config ssh.TunnelConfig) {
+	defer attempt.cancel()
 
-	promURL, err := url.Parse(d.settings.PrometheusURL)
+	tunnel, err := ssh.NewTunnel(ctx, config)
 	if err != nil {
-		return fmt.Errorf("invalid prometheus URL: %w", err)
+		err = fmt.Errorf("failed to create SSH tunnel: %w", err)
 	}
 
-	config.RemoteHost = promURL.Hostname()
-	port := promURL.Port()
-	if port == "" {
-		if promURL.Scheme == "https" {
-			port = "443"
+	d.tunnelMu.Lock()
+	if d.connecting == attempt {
+		d.connecting = nil
+	}
+	if err == nil {
+		if d.disposed || d.tunnel != nil {
+			tunnel.Close()
 		} else {
-			port = "80"
+			d.tunnel = tunnel
+			log.DefaultLogger.Info("SSH tunnel established", "host", tunnel.Endpoint(), "jumpHosts", len(config.JumpHosts))
 		}
 	}
-	config.RemotePort, _ = strconv.Atoi(port)
+	attempt.err = err
+	d.tunnelMu.Unlock()
+
+	close(attempt.done)
+}
 
-	tunnel, err := ssh.NewTunnel(config)
+// prometheusTunnelConfig returns the tunnel configuration forwarding to the
+// configured Prometheus URL.
+func (d *Datasource) prometheusTunnelConfig() (ssh.TunnelConfig, error) {
+	config := d.tunnelConfig()
+
+	target, err := parsePrometheusURL(d.settings.PrometheusURL)
 	if err != nil {
-		return fmt.Errorf("failed to create SSH tunnel: %w", err)
+		return config, fmt.Errorf("invalid prometheus URL: %w", err)
+	}
+	config.RemoteHost = target.remoteHost
+	config.RemotePort = target.remotePort
+	config.RemoteSocket = target.socket
+
+	config.LocalListener = d.settings.LocalListener
+	config.KeepaliveInterval = time.Duration(d.settings.KeepaliveInterval) * time.Second
+	config.KeepaliveMaxMisses = d.settings.KeepaliveMaxMisses
+	config.IdleTimeout = time.Duration(d.settings.IdleTimeout) * time.Second
+	config.Targets = d.tunnelTargets()
+	config.Transport = d.settings.Transport
+	config.ExecCommand = d.settings.ExecCommand
+	if d.settings.DrainTimeout > 0 {
+		config.DrainTimeout = time.Duration(d.settings.DrainTimeout) * time.Second
 	}
 
-	d.tunnel = tunnel
-	log.DefaultLogger.Info("SSH tunnel established", "host", d.settings.SSHHost)
-	return nil
+	return config, nil
 }
 
-func (d *Datasource) getLocalURL() string {
-	promURL, _ := url.Parse(d.settings.PrometheusURL)
-	scheme := promURL.Scheme
-	if scheme == "" {
-		scheme = "http"
+// dialTunnel opens a connection to Prometheus through the SSH tunnel.
+func (d *Datasource) dialTunnel(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.tunnelMu.Lock()
+	tunnel := d.tunnel
+	d.tunnelMu.Unlock()
+
+	if tunnel == nil {
+		return nil, fmt.Errorf("SSH tunnel is not established")
+	}
+	return tunnel.DialContext(ctx, network, addr)
+}
+
+// baseURL returns the URL Prometheus requests are sent to. By default this is
+// the configured Prometheus URL, whose connections are dialed through the
+// tunnel; with a local listener it points at the listener instead.
+func (d *Datasource) baseURL() (string, error) {
+	target, _ := parsePrometheusURL(d.settings.PrometheusURL)
+	if d.settings.LocalListener {
+		// The tunnel may be closed concurrently by Dispose or replaced by
+		// ensureTunnel.
+		d.tunnelMu.Lock()
+		defer d.tunnelMu.Unlock()
+		if d.tunnel == nil {
+			return "", errors.New("SSH tunnel is closed")
+		}
+		return fmt.Sprintf("%s://%s%s", target.scheme, d.tunnel.LocalAddr(), target.pathPrefix), nil
 	}
-	return fmt.Sprintf("%s://%s", scheme, d.tunnel.LocalAddr())
+	return fmt.Sprintf("%s://%s%s", target.scheme, target.host, target.pathPrefix), nil
+}
+
+// prometheusTarget is where Prometheus listens as seen from the SSH host.
+type prometheusTarget struct {
+	scheme     string
+	host       string
+	remoteHost string
+	remotePort int
+	// socket is set for unix:// URLs, which may carry an HTTP path prefix.
+	socket     string
+	pathPrefix string
+}
+
+// parsePrometheusURL parses the configured Prometheus URL. Besides http and
+// https URLs it accepts unix:///path/to/socket for Prometheus listening on a
+// Unix socket of the SSH host, optionally followed by ":/prefix" for an HTTP
+// path prefix, e.g. unix:///run/thanos/query.sock:/thanos.
+func parsePrometheusURL(rawURL string) (prometheusTarget, error) {
+	promURL, err := url.Parse(rawURL)
+	if err != nil {
+		return prometheusTarget{}, err
+	}
+
+	if promURL.Scheme == "unix" {
+		socket, prefix, found := strings.Cut(promURL.Path, ":/")
+		if socket == "" {
+			return prometheusTarget{}, fmt.Errorf("missing socket path in %q", rawURL)
+		}
+		target := prometheusTarget{
+			scheme: "http",
+			host:   "localhost",
+			socket: socket,
+		}
+		if prefix = strings.Trim(prefix, "/"); found && prefix != "" {
+			target.pathPrefix = "/" + prefix
+		}
+		return target, nil
+	}
+
+	target := prometheusTarget{
+		scheme:     promURL.Scheme,
+		host:       promURL.Host,
+		remoteHost: promURL.Hostname(),
+	}
+	if target.scheme == "" {
+		target.scheme = "http"
+	}
+
+	port := promURL.Port()
+	if port == "" {
+		if promURL.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	target.remotePort, _ = strconv.Atoi(port)
+
+	return target, nil
 }
 
 func (d *Datasource) addPrometheusAuth(req *http.Request) {
@@ -261,11 +689,28 @@ type queryModel struct {
 	Instant      bool   `json:"instant"`
 	Range        bool   `json:"range"`
 	Interval     string `json:"interval"`
+	// Format is "time_series" (default), "table" or "heatmap".
+	Format string `json:"format"`
+	// Exemplar adds the exemplars of range queries as an extra frame.
+	Exemplar bool `json:"exemplar"`
+	// HistogramFormat renders native histograms as "buckets" or
+	// "count_sum"; the default is buckets for the heatmap format and
+	// count_sum otherwise.
+	HistogramFormat string `json:"histogramFormat"`
 }
 
-func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) backend.DataResponse {
+func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, query backend.DataQuery) (res backend.DataResponse) {
+	// Queries without an expression are not sent and not measured.
+	var endpoint string
+	defer func(start time.Time) {
+		if endpoint != "" {
+			d.observeRequest("query_data", endpoint, dataResponseStatus(res), start)
+		}
+	}(time.Now())
+
 	var qm queryModel
 	if err := json.Unmarshal(query.JSON, &qm); err != nil {
+		endpoint = "invalid"
 		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("failed to parse query: %v", err))
 	}
 
@@ -273,9 +718,54 @@ func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, quer
 		return backend.DataResponse{}
 	}
 
-	var endpoint string
+	params := d.queryParams(qm.Expr)
+
+	if qm.Range && !qm.Instant {
+		endpoint = "/api/v1/query_range"
+		params.Set("start", strconv.FormatInt(query.TimeRange.From.Unix(), 10))
+		params.Set("end", strconv.FormatInt(query.TimeRange.To.Unix(), 10))
+		step := d.calculateStep(query.TimeRange.From, query.TimeRange.To, query.MaxDataPoints, qm.Interval)
+		params.Set("step", strconv.FormatInt(step, 10))
+	} else {
+		endpoint = "/api/v1/query"
+		params.Set("time", strconv.FormatInt(query.TimeRange.To.Unix(), 10))
+	}
+
+	httpReq, err := d.newPrometheusRequest(ctx, endpoint, params)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("failed to create request: %v", err))
+	}
+
+	resp, err := d.httpClient.Do(httpReq)
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusBadGateway, fmt.Sprintf("prometheus request failed: %v", err))
+	}
+	defer resp.Body.Close()
+
+	promResp, err := decodeResponse(d.limitBody(resp.Body))
+	if errors.Is(err, errResponseTooLarge) {
+		return backend.ErrDataResponse(backend.StatusBadRequest, fmt.Sprintf("prometheus response exceeds the maximum response size of %d MB, narrow the query or raise maxResponseSize", d.settings.MaxResponseSize))
+	}
+	if err != nil {
+		return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("failed to parse prometheus response: %v", err))
+	}
+
+	if promResp.Status != "success" {
+		return backend.ErrDataResponse(backend.StatusBadRequest, promResp.Error)
+	}
+
+	frames := d.transformResponse(promResp, qm, query.RefID)
+	if qm.Exemplar && qm.Range && !qm.Instant {
+		frames = append(frames, d.queryExemplars(ctx, qm.Expr, query))
+	}
+	return backend.DataResponse{Frames: frames}
+}
+
+// queryParams returns the parameters of a request for expr, including the
+// custom query parameters.
+func (d *Datasource) queryParams(expr string) url.Values {
 	params := url.Values{}
-	params.Set("query", qm.Expr)
+	params.Set("query", expr)
 
 	// Add custom query parameters
 	if d.settings.CustomQueryParameters != "" {
@@ -289,70 +779,46 @@ func (d *Datasource) query(ctx context.Context, pCtx backend.PluginContext, quer
 		}
 	}
 
-	if qm.Range && !qm.Instant {
-		endpoint = "/api/v1/query_range"
-		params.Set("start", strconv.FormatInt(query.TimeRange.From.Unix(), 10))
-		params.Set("end", strconv.FormatInt(query.TimeRange.To.Unix(), 10))
-		step := d.calculateStep(query.TimeRange.From, query.TimeRange.To, query.MaxDataPoints, qm.Interval)
-		params.Set("step", strconv.FormatInt(step, 10))
-	} else {
-		endpoint = "/api/v1/query"
-		params.Set("time", strconv.FormatInt(query.TimeRange.To.Unix(), 10))
-	}
+	return params
+}
 
-	reqURL := fmt.Sprintf("%s%s", d.getLocalURL(), endpoint)
+// newPrometheusRequest builds an authenticated request to a query API
+// endpoint with the configured HTTP method.
+func (d *Datasource) newPrometheusRequest(ctx context.Context, endpoint string, params url.Values) (*http.Request, error) {
+	baseURL, err := d.baseURL()
+	if err != nil {
+		return nil, err
+	}
+	reqURL := fmt.Sprintf("%s%s", baseURL, endpoint)
 
 	var httpReq *http.Request
-	var err error
 
 	if d.settings.HTTPMethod == "POST" {
 		httpReq, err = http.NewRequestWithContext(ctx, "POST", reqURL, strings.NewReader(params.Encode()))
 		if err != nil {
-			return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("failed to create request: %v", err))
+			return nil, err
 		}
 		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	} else {
 		reqURL = fmt.Sprintf("%s?%s", reqURL, params.Encode())
 		httpReq, err = http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 		if err != nil {
-			return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("failed to create request: %v", err))
+			return nil, err
 		}
 	}
 
 	// Add Prometheus authentication
 	d.addPrometheusAuth(httpReq)
 
-	resp, err := d.httpClient.Do(httpReq)
-	if err != nil {
-		return backend.ErrDataResponse(backend.StatusBadGateway, fmt.Sprintf("prometheus request failed: %v", err))
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("failed to read response: %v", err))
-	}
-
-	var promResp prometheusResponse
-	if err := json.Unmarshal(body, &promResp); err != nil {
-		return backend.ErrDataResponse(backend.StatusInternal, fmt.Sprintf("failed to parse prometheus response: %v", err))
-	}
-
-	if promResp.Status != "success" {
-		return backend.ErrDataResponse(backend.StatusBadRequest, promResp.Error)
-	}
-
-	frames := d.transformResponse(promResp, qm.LegendFormat, query.RefID)
-	return backend.DataResponse{Frames: frames}
+	return httpReq, nil
 }
 
-type prometheusResponse struct {
-	Status string `json:"status"`
-	Error  string `json:"error,omitempty"`
-	Data   struct {
-		ResultType string        `json:"resultType"`
-		Result     []interface{} `json:"result"`
-	} `json:"data"`
+// limitBody applies maxResponseSize to a response body.
+func (d *Datasource) limitBody(body io.Reader) io.Reader {
+	if d.settings.MaxResponseSize > 0 {
+		return &limitReader{r: body, n: int64(d.settings.MaxResponseSize) << 20}
+	}
+	return body
 }
 
 func (d *Datasource) calculateStep(from, to time.Time, maxDataPoints int64, interval string) int64 {
@@ -393,61 +859,44 @@ func parseInterval(interval string) int64 {
 	}
 }
 
-func (d *Datasource) transformResponse(resp prometheusResponse, legendFormat, refID string) data.Frames {
-	var frames data.Frames
+func (d *Datasource) transformResponse(resp *prometheusResponse, qm queryModel, refID string) data.Frames {
+	if resp.String != nil {
+		return data.Frames{stringFrame(*resp.String, refID)}
+	}
 
-	for _, r := range resp.Data.Result {
-		result, ok := r.(map[string]interface{})
-		if !ok {
-			continue
+	// Native histograms are rendered on their own, as buckets for heatmaps
+	// and as count and sum otherwise unless the query says differently.
+	var series, histograms []promSeries
+	for _, s := range resp.Series {
+		if len(s.histograms) > 0 {
+			histograms = append(histograms, s)
 		}
-
-		metric, _ := result["metric"].(map[string]interface{})
-		labels := make(map[string]string)
-		for k, v := range metric {
-			if s, ok := v.(string); ok {
-				labels[k] = s
-			}
+		if s.times.Len() > 0 || len(s.histograms) == 0 {
+			series = append(series, s)
 		}
-
-		name := formatLegend(labels, legendFormat)
-		frame := data.NewFrame(name)
-		frame.RefID = refID
-
-		var times []time.Time
-		var values []float64
-
-		if resp.Data.ResultType == "matrix" {
-			valuesRaw, _ := result["values"].([]interface{})
-			for _, v := range valuesRaw {
-				point, ok := v.([]interface{})
-				if !ok || len(point) != 2 {
-					continue
-				}
-				ts, _ := point[0].(float64)
-				val, _ := point[1].(string)
-				parsedVal, _ := strconv.ParseFloat(val, 64)
-				times = append(times, time.Unix(int64(ts), 0))
-				values = append(values, parsedVal)
-			}
-		} else if resp.Data.ResultType == "vector" {
-			valueRaw, _ := result["value"].([]interface{})
-			if len(valueRaw) == 2 {
-				ts, _ := valueRaw[0].(float64)
-				val, _ := valueRaw[1].(string)
-				parsedVal, _ := strconv.ParseFloat(val, 64)
-				times = append(times, time.Unix(int64(ts), 0))
-				values = append(values, parsedVal)
-			}
+	}
+	histogramFormat := qm.HistogramFormat
+	if histogramFormat == "" {
+		histogramFormat = histogramFormatCountSum
+		if qm.Format == formatHeatmap {
+			histogramFormat = histogramFormatBuckets
 		}
-
-		frame.Fields = append(frame.Fields, data.NewField("time", nil, times))
-		valueField := data.NewField("value", labels, values)
-		frame.Fields = append(frame.Fields, valueField)
-		frames = append(frames, frame)
+	}
+	histogramFrames := histogramFrames(histograms, histogramFormat, qm.LegendFormat, refID)
+	if len(series) == 0 && len(histograms) > 0 {
+		return histogramFrames
 	}
 
-	return frames
+	var frames data.Frames
+	switch qm.Format {
+	case formatTable:
+		frames = data.Frames{tableFrame(series, refID)}
+	case formatHeatmap:
+		frames = heatmapFrames(series, qm.LegendFormat, refID)
+	default:
+		frames = timeSeriesFrames(series, qm.LegendFormat, refID)
+	}
+	return append(frames, histogramFrames...)
 }
 
 func formatLegend(labels map[string]string, format string) string {
@@ -471,20 +920,111 @@ func formatLegend(labels map[string]string, format string) string {
 }
 
 func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	// The health check brings an idle tunnel back up, so its state is taken
+	// before.
+	tunnel := d.tunnelDetails()
+	result := d.checkHealth(ctx)
+
+	d.tunnelMu.Lock()
+	tunnel.Connected = d.tunnel != nil && d.tunnel.Ready() == nil
+	if d.tunnel != nil {
+		tunnel.Transport = d.tunnel.Transport()
+		tunnel.Hops = d.tunnel.Hops()
+	}
+	d.tunnelMu.Unlock()
+
+	details := healthDetails{Tunnel: tunnel}
+	if len(d.settings.SSHHosts) > 0 {
+		d.tunnelMu.Lock()
+		connected := ""
+		if d.tunnel != nil {
+			connected = d.tunnel.Endpoint()
+		}
+		d.tunnelMu.Unlock()
+
+		details.SSHHosts = ssh.EndpointStates(d.tunnelConfig(), connected)
+
+		var unhealthy []string
+		for _, state := range details.SSHHosts {
+			if !state.Healthy {
+				unhealthy = append(unhealthy, state.Address)
+			}
+		}
+		if len(unhealthy) > 0 && result.Status == backend.HealthStatusOk {
+			result.Message = fmt.Sprintf("%s. Warning: SSH hosts unhealthy: %s", result.Message, strings.Join(unhealthy, ", "))
+		}
+	}
+
+	jsonDetails, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	result.JSONDetails = jsonDetails
+
+	return result, nil
+}
+
+// healthDetails is returned as the JSON details of health checks.
+type healthDetails struct {
+	Tunnel   *tunnelDetails      `json:"tunnel"`
+	SSHHosts []ssh.EndpointState `json:"sshHosts,omitempty"`
+}
+
+// tunnelDetails describes the tunnel. Idle is set when the tunnel had been
+// closed for inactivity before the health check, LastActivity is the last
+// transfer before the health check and Connected, Transport and Hops the
+// state after it.
+type tunnelDetails struct {
+	Connected    bool          `json:"connected"`
+	Transport    string        `json:"transport,omitempty"`
+	Hops         []ssh.HopInfo `json:"hops,omitempty"`
+	Idle         bool          `json:"idle"`
+	IdleTimeout  int           `json:"idleTimeout,omitempty"` // seconds
+	LastActivity *time.Time    `json:"lastActivity,omitempty"`
+}
+
+func (d *Datasource) tunnelDetails() *tunnelDetails {
+	d.tunnelMu.Lock()
+	defer d.tunnelMu.Unlock()
+
+	details := &tunnelDetails{IdleTimeout: d.settings.IdleTimeout}
+	if d.tunnel != nil {
+		lastActivity := d.tunnel.LastActivity()
+		details.LastActivity = &lastActivity
+		details.Idle = d.tunnel.IdleClosed()
+	}
+	return details
+}
+
+func (d *Datasource) checkHealth(ctx context.Context) *backend.CheckHealthResult {
 	if err := d.ensureTunnel(ctx); err != nil {
+		var proxyErr *ssh.ProxyError
+		if errors.As(err, &proxyErr) {
+			return &backend.CheckHealthResult{
+				Status:  backend.HealthStatusError,
+				Message: fmt.Sprintf("Failed to connect through proxy: %s", proxyErr.Error()),
+			}
+		}
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: fmt.Sprintf("Failed to establish SSH tunnel: %s", err.Error()),
-		}, nil
+		}
 	}
 
-	reqURL := fmt.Sprintf("%s/api/v1/query?query=1", d.getLocalURL())
+	baseURL, err := d.baseURL()
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: fmt.Sprintf("Failed to establish SSH tunnel: %s", err.Error()),
+		}
+	}
+	reqURL := fmt.Sprintf("%s/api/v1/query?query=1", baseURL)
 	httpReq, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: fmt.Sprintf("Failed to create request: %s", err.Error()),
-		}, nil
+		}
 	}
 
 	// Add Prometheus authentication for health check
@@ -495,7 +1035,7 @@ func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRe
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: fmt.Sprintf("Failed to connect to Prometheus: %s", err.Error()),
-		}, nil
+		}
 	}
 	defer resp.Body.Close()
 
@@ -503,71 +1043,217 @@ func (d *Datasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRe
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: "Prometheus authentication failed (401 Unauthorized)",
-		}, nil
+		}
 	}
 
 	if resp.StatusCode == http.StatusForbidden {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: "Prometheus access forbidden (403 Forbidden)",
-		}, nil
+		}
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		return &backend.CheckHealthResult{
 			Status:  backend.HealthStatusError,
 			Message: fmt.Sprintf("Prometheus returned status %d", resp.StatusCode),
-		}, nil
+		}
+	}
+
+	message := "SSH connection and Prometheus are working"
+	if warnings := d.certificateWarnings(time.Now()); len(warnings) > 0 {
+		message = fmt.Sprintf("%s. Warning: %s", message, strings.Join(warnings, "; "))
 	}
 
 	return &backend.CheckHealthResult{
 		Status:  backend.HealthStatusOk,
-		Message: "SSH connection and Prometheus are working",
-	}, nil
+		Message: message,
+	}
+}
+
+// certificateWarnings reports SSH certificates of the chain that expire
+// within the configured warning window.
+func (d *Datasource) certificateWarnings(now time.Time) []string {
+	window := time.Duration(d.settings.SSHCertExpiryWarningHours) * time.Hour
+
+	var warnings []string
+	for _, hop := range d.tunnelConfig().Hops() {
+		if hop.SSHCertificate == "" {
+			continue
+		}
+		expiry, err := ssh.CertificateExpiry(hop.SSHCertificate)
+		if err != nil || expiry.IsZero() {
+			continue
+		}
+		if remaining := expiry.Sub(now); remaining < window {
+			warnings = append(warnings, fmt.Sprintf("SSH certificate for %s@%s expires in %s (%s)",
+				hop.SSHUsername, hop.SSHHost, remaining.Truncate(time.Minute), expiry.Format(time.RFC3339)))
+		}
+	}
+	return warnings
 }
 
 func (d *Datasource) handleTestSSH(ctx context.Context, sender backend.CallResourceResponseSender) error {
-	config := ssh.TunnelConfig{
-		SSHHost:     d.settings.SSHHost,
-		SSHPort:     d.settings.SSHPort,
-		SSHUsername: d.settings.SSHUsername,
-		AuthMethod:  d.settings.AuthMethod,
-		RemoteHost:  "localhost",
-		RemotePort:  22,
+	config := d.tunnelConfig()
+	config.RemoteHost = "localhost"
+	config.RemotePort = 22
+
+	// Test SSH connection only (without creating a tunnel)
+	result := testSSHResult{Status: "ok", Message: "SSH connection successful"}
+	info, err := ssh.TestConnection(ctx, config)
+	if err != nil {
+		result = testSSHResult{Status: "error", Stage: "ssh", Message: fmt.Sprintf("SSH connection failed: %s", err.Error())}
+
+		var proxyErr *ssh.ProxyError
+		if errors.As(err, &proxyErr) {
+			result.Stage = "proxy"
+			result.Message = fmt.Sprintf("Proxy connection failed: %s", proxyErr.Error())
+		}
+
+		var mismatch *ssh.HostKeyMismatchError
+		if errors.As(err, &mismatch) {
+			result.PresentedFingerprint = mismatch.Presented
+			result.ExpectedFingerprints = mismatch.Expected
+		}
+
+		var hopErr *ssh.HopError
+		if errors.As(err, &hopErr) {
+			result.FailedHop = hopErr.Index + 1
+			result.FailedHost = hopErr.Host
+		}
 	}
 
-	if d.settings.AuthMethod == "password" {
-		config.SSHPassword = d.secureData["sshPassword"]
-	} else {
-		config.SSHPrivateKey = d.secureData["sshPrivateKey"]
-		config.SSHKeyPassphrase = d.secureData["sshKeyPassphrase"]
+	result.Hops = info.Hops
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
 	}
 
-	// Test SSH connection only (without creating a tunnel)
-	err := ssh.TestConnection(config)
+	return sender.Send(&backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Headers: map[string][]string{
+			"Content-Type": {"application/json"},
+		},
+		Body: body,
+	})
+}
+
+type testSSHResult struct {
+	Status string `json:"status"`
+	// Stage is "proxy" or "ssh" for failed connections.
+	Stage                string        `json:"stage,omitempty"`
+	Message              string        `json:"message"`
+	PresentedFingerprint string        `json:"presentedFingerprint,omitempty"`
+	ExpectedFingerprints []string      `json:"expectedFingerprints,omitempty"`
+	FailedHop            int           `json:"failedHop,omitempty"`
+	FailedHost           string        `json:"failedHost,omitempty"`
+	Hops                 []ssh.HopInfo `json:"hops,omitempty"`
+}
+
+// handlePoolStats reports the pooled SSH connections of this datasource's
+// configuration, which other datasources with the same settings may share.
+func (d *Datasource) handlePoolStats(sender backend.CallResourceResponseSender) error {
+	stats, err := ssh.DefaultPool.StatsFor(d.tunnelConfig())
+	if err != nil {
+		return sender.Send(&backend.CallResourceResponse{
+			Status: http.StatusInternalServerError,
+			Body:   []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())),
+		})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"connections": stats,
+		"total":       len(stats),
+	})
 	if err != nil {
+		return err
+	}
+
+	return sender.Send(&backend.CallResourceResponse{
+		Status: http.StatusOK,
+		Headers: map[string][]string{
+			"Content-Type": {"application/json"},
+		},
+		Body: body,
+	})
+}
+
+// handleValidateKey describes the private key in the request body, or the
+// stored key when the body has none, without connecting anywhere.
+func (d *Datasource) handleValidateKey(req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	var params validateKeyRequest
+	if len(req.Body) > 0 {
+		if err := json.Unmarshal(req.Body, &params); err != nil {
+			return sender.Send(&backend.CallResourceResponse{
+				Status: http.StatusBadRequest,
+				Body:   []byte(fmt.Sprintf(`{"error": "invalid request body: %s"}`, err.Error())),
+			})
+		}
+	}
+	if params.PrivateKey == "" {
+		params.PrivateKey = d.secureData["sshPrivateKey"]
+		params.Passphrase = d.secureData["sshKeyPassphrase"]
+	}
+	if params.PrivateKey == "" {
 		return sender.Send(&backend.CallResourceResponse{
-			Status: http.StatusOK,
-			Headers: map[string][]string{
-				"Content-Type": {"application/json"},
-			},
-			Body: []byte(fmt.Sprintf(`{"status": "error", "message": "SSH connection failed: %s"}`, err.Error())),
+			Status: http.StatusBadRequest,
+			Body:   []byte(`{"error": "no private key provided"}`),
 		})
 	}
 
+	result := validateKeyResult{Valid: true}
+	info, err := ssh.InspectPrivateKey(params.PrivateKey, params.Passphrase)
+	if err != nil {
+		result = validateKeyResult{Message: err.Error()}
+	} else {
+		result.KeyInfo = info
+		result.Valid = !info.NeedsPassphrase
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
 	return sender.Send(&backend.CallResourceResponse{
 		Status: http.StatusOK,
 		Headers: map[string][]string{
 			"Content-Type": {"application/json"},
 		},
-		Body: []byte(`{"status": "ok", "message": "SSH connection successful"}`),
+		Body: body,
 	})
 }
 
+type validateKeyRequest struct {
+	PrivateKey string `json:"privateKey"`
+	Passphrase string `json:"passphrase"`
+}
+
+type validateKeyResult struct {
+	// Valid is false when the key cannot be parsed or needs a passphrase
+	// that was not given.
+	Valid bool `json:"valid"`
+	*ssh.KeyInfo
+	Message string `json:"message,omitempty"`
+}
+
 func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
-	// Handle SSH-only test endpoint
-	if req.Path == "test-ssh" {
+	start := time.Now()
+	recorder := &statusRecorder{CallResourceResponseSender: sender}
+	err := d.callResource(ctx, req, recorder)
+	d.observeRequest("call_resource", d.resourceEndpoint(req.Path), recorder.status, start)
+	return err
+}
+
+func (d *Datasource) callResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	// Handle SSH-only endpoints
+	switch req.Path {
+	case "test-ssh":
 		return d.handleTestSSH(ctx, sender)
+	case "pool-stats":
+		return d.handlePoolStats(sender)
+	case "validate-key":
+		return d.handleValidateKey(req, sender)
 	}
 
 	if err := d.ensureTunnel(ctx); err != nil {
@@ -577,6 +1263,10 @@ func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResource
 		})
 	}
 
+	if target, path, ok := d.matchTarget(req); ok {
+		return d.callTarget(ctx, target, path, req, sender)
+	}
+
 	path := req.Path
 	if len(req.URL) > len(req.Path) {
 		path = req.URL
@@ -585,7 +1275,14 @@ func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResource
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
 	}
-	targetURL := fmt.Sprintf("%s%s", d.getLocalURL(), path)
+	baseURL, err := d.baseURL()
+	if err != nil {
+		return sender.Send(&backend.CallResourceResponse{
+			Status: http.StatusBadGateway,
+			Body:   []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())),
+		})
+	}
+	targetURL := fmt.Sprintf("%s%s", baseURL, path)
 
 	var body io.Reader
 	var contentType string
@@ -643,7 +1340,12 @@ func (d *Datasource) CallResource(ctx context.Context, req *backend.CallResource
 		}
 	}
 
-	resp, err := d.httpClient.Do(httpReq)
+	return sendResourceResponse(d.httpClient, httpReq, sender)
+}
+
+// sendResourceResponse sends httpReq with client and relays the response.
+func sendResourceResponse(client *http.Client, httpReq *http.Request, sender backend.CallResourceResponseSender) error {
+	resp, err := client.Do(httpReq)
 	if err != nil {
 		return sender.Send(&backend.CallResourceResponse{
 			Status: http.StatusBadGateway,
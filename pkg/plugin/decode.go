@@ -0,0 +1,406 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// prometheusResponse is a decoded query API response.
+type prometheusResponse struct {
+	Status     string
+	ErrorType  string
+	Error      string
+	ResultType string
+	// Series holds matrix and vector results; a scalar is a single series
+	// without labels.
+	Series []promSeries
+	// String holds a string result.
+	String *stringSample
+}
+
+type stringSample struct {
+	time  time.Time
+	value string
+}
+
+// errResponseTooLarge is returned when a response exceeds the configured
+// maxResponseSize.
+var errResponseTooLarge = errors.New("response too large")
+
+// limitReader fails with errResponseTooLarge once more than n bytes were
+// read, rather than truncating the body like io.LimitReader.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		// The byte past the limit is not returned, or a response that
+		// ends with it would decode.
+		n, l.n = int(l.n), -1
+		return n, errResponseTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// decodeResponse decodes a query API response while reading it. Only one
+// series at a time is held as JSON; its samples are parsed into typed
+// vectors without going through interface values.
+func decodeResponse(r io.Reader) (*prometheusResponse, error) {
+	dec := json.NewDecoder(r)
+	resp := &prometheusResponse{}
+
+	err := decodeObject(dec, func(key string) error {
+		switch key {
+		case "status":
+			return dec.Decode(&resp.Status)
+		case "errorType":
+			return dec.Decode(&resp.ErrorType)
+		case "error":
+			return dec.Decode(&resp.Error)
+		case "data":
+			return decodeData(dec, resp)
+		default:
+			return skipValue(dec)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func decodeData(dec *json.Decoder, resp *prometheusResponse) error {
+	// Prometheus writes resultType first; otherwise the result has to be
+	// buffered until its type is known.
+	var pending json.RawMessage
+	err := decodeObject(dec, func(key string) error {
+		switch key {
+		case "resultType":
+			return dec.Decode(&resp.ResultType)
+		case "result":
+			if resp.ResultType == "" {
+				return dec.Decode(&pending)
+			}
+			return decodeResult(dec, resp)
+		default:
+			return skipValue(dec)
+		}
+	})
+	if err != nil || pending == nil {
+		return err
+	}
+	return decodeResult(json.NewDecoder(bytes.NewReader(pending)), resp)
+}
+
+func decodeResult(dec *json.Decoder, resp *prometheusResponse) error {
+	switch resp.ResultType {
+	case "matrix", "vector":
+		return decodeArray(dec, func() error {
+			s, err := decodeSeries(dec)
+			if err == nil {
+				resp.Series = append(resp.Series, s)
+			}
+			return err
+		})
+	case "scalar":
+		s := newPromSeries()
+		if err := dec.Decode((*samplePair)(&s)); err != nil {
+			return err
+		}
+		s.labels = map[string]string{}
+		resp.Series = []promSeries{s}
+		return nil
+	case "string":
+		var pair []json.RawMessage
+		if err := dec.Decode(&pair); err != nil {
+			return err
+		}
+		var ts float64
+		var value string
+		if len(pair) != 2 || json.Unmarshal(pair[0], &ts) != nil || json.Unmarshal(pair[1], &value) != nil {
+			return fmt.Errorf("malformed string result")
+		}
+		resp.String = &stringSample{time: promTime(ts), value: value}
+		return nil
+	default:
+		return skipValue(dec)
+	}
+}
+
+// decodeSeries decodes one {"metric": ..., "values"|"value": ...} object,
+// including native histograms under "histograms" or "histogram".
+func decodeSeries(dec *json.Decoder) (promSeries, error) {
+	s := newPromSeries()
+	raw := struct {
+		Metric     map[string]string `json:"metric"`
+		Values     *sampleArray      `json:"values"`
+		Value      *samplePair       `json:"value"`
+		Histograms *histogramArray   `json:"histograms"`
+		Histogram  *histogramPair    `json:"histogram"`
+	}{
+		Values:     (*sampleArray)(&s),
+		Value:      (*samplePair)(&s),
+		Histograms: (*histogramArray)(&s),
+		Histogram:  (*histogramPair)(&s),
+	}
+	if err := dec.Decode(&raw); err != nil {
+		return s, err
+	}
+	s.labels = raw.Metric
+	if s.labels == nil {
+		s.labels = map[string]string{}
+	}
+	return s, nil
+}
+
+// sampleArray decodes [[timestamp, "value"], ...] into the fields of a
+// promSeries.
+type sampleArray promSeries
+
+func (a *sampleArray) UnmarshalJSON(b []byte) error {
+	s := (*promSeries)(a)
+	p := sampleScanner{b: b}
+	if !p.consume('[') {
+		return errMalformedSamples
+	}
+	// Every sample opens one bracket, so this is exact unless a value
+	// contains brackets. Rows reserved for dropped samples are removed at
+	// the end.
+	row := s.times.Len()
+	n := bytes.Count(b, []byte{'['}) - 1
+	s.times.Extend(n)
+	s.values.Extend(n)
+	defer func() {
+		for s.times.Len() > row {
+			s.times.Delete(s.times.Len() - 1)
+			s.values.Delete(s.values.Len() - 1)
+		}
+	}()
+	if p.consume(']') {
+		return nil
+	}
+	for {
+		t, v, ok, err := s.scanPair(&p)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if row < s.times.Len() {
+				// Pointers to the reserved rows avoid boxing every sample.
+				*s.times.PointerAt(row).(*time.Time) = t
+				*s.values.PointerAt(row).(*float64) = v
+			} else {
+				s.times.Append(t)
+				s.values.Append(v)
+			}
+			row++
+		}
+		if p.consume(',') {
+			continue
+		}
+		if p.consume(']') {
+			return nil
+		}
+		return errMalformedSamples
+	}
+}
+
+// samplePair decodes a single [timestamp, "value"] into the fields of a
+// promSeries.
+type samplePair promSeries
+
+func (sp *samplePair) UnmarshalJSON(b []byte) error {
+	s := (*promSeries)(sp)
+	p := sampleScanner{b: b}
+	t, v, ok, err := s.scanPair(&p)
+	if ok {
+		s.times.Append(t)
+		s.values.Append(v)
+	}
+	return err
+}
+
+var errMalformedSamples = errors.New("malformed samples")
+
+// scanPair parses a [timestamp, "value"] pair. ok is false for values that
+// cannot be parsed, which are counted and reported as a notice instead.
+func (s *promSeries) scanPair(p *sampleScanner) (t time.Time, v float64, ok bool, err error) {
+	if !p.consume('[') {
+		return t, v, false, errMalformedSamples
+	}
+	tsToken := p.token()
+	if !p.consume(',') {
+		return t, v, false, errMalformedSamples
+	}
+	valToken, quoted := p.token(), false
+	if len(valToken) == 0 {
+		if valToken, ok = p.str(); !ok {
+			return t, v, false, errMalformedSamples
+		}
+		quoted = true
+	}
+	if !p.consume(']') {
+		return t, v, false, errMalformedSamples
+	}
+
+	ts, err := strconv.ParseFloat(string(tsToken), 64)
+	if err != nil {
+		s.addInvalid(fmt.Errorf("invalid timestamp %s", tsToken))
+		return t, v, false, nil
+	}
+	if !quoted {
+		s.addInvalid(fmt.Errorf("invalid sample value %s", valToken))
+		return t, v, false, nil
+	}
+	// Prometheus writes NaN, +Inf and -Inf, which ParseFloat accepts.
+	v, err = strconv.ParseFloat(string(valToken), 64)
+	if err != nil {
+		s.addInvalid(fmt.Errorf("invalid sample value %q", valToken))
+		return t, v, false, nil
+	}
+	return promTime(ts), v, true, nil
+}
+
+func (s *promSeries) addInvalid(err error) {
+	if s.invalid == 0 {
+		s.invalidErr = err
+	}
+	s.invalid++
+}
+
+// promTime converts a Prometheus timestamp to a time rounded to the
+// millisecond.
+func promTime(ts float64) time.Time {
+	return time.UnixMilli(int64(math.Round(ts * 1000)))
+}
+
+// sampleScanner reads the tokens of sample pairs. It does not validate JSON
+// beyond what is needed to find them; encoding/json already did.
+type sampleScanner struct {
+	b []byte
+	i int
+}
+
+func (p *sampleScanner) skipSpace() {
+	for p.i < len(p.b) {
+		switch p.b[p.i] {
+		case ' ', '\t', '\n', '\r':
+			p.i++
+		default:
+			return
+		}
+	}
+}
+
+func (p *sampleScanner) consume(c byte) bool {
+	p.skipSpace()
+	if p.i < len(p.b) && p.b[p.i] == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+// token returns an unquoted literal such as a number, or nothing when the
+// next value is a string.
+func (p *sampleScanner) token() []byte {
+	p.skipSpace()
+	start := p.i
+	for p.i < len(p.b) {
+		switch p.b[p.i] {
+		case ',', ']', '"', ' ', '\t', '\n', '\r':
+			return p.b[start:p.i]
+		}
+		p.i++
+	}
+	return p.b[start:p.i]
+}
+
+// str returns the contents of a string without escape sequences, which
+// Prometheus never writes in sample values.
+func (p *sampleScanner) str() ([]byte, bool) {
+	if !p.consume('"') {
+		return nil, false
+	}
+	start := p.i
+	for p.i < len(p.b) {
+		switch p.b[p.i] {
+		case '"':
+			p.i++
+			return p.b[start : p.i-1], true
+		case '\\':
+			return nil, false
+		}
+		p.i++
+	}
+	return nil, false
+}
+
+// decodeObject calls field for every key of the next JSON object, which must
+// decode the value.
+func decodeObject(dec *json.Decoder, field func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected %v", tok)
+		}
+		if err := field(key); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// decodeArray calls elem for every element of the next JSON array, which
+// must decode the element.
+func decodeArray(dec *json.Decoder, elem func() error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := elem(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+	return nil
+}
+
+// skipValue discards the next JSON value.
+func skipValue(dec *json.Decoder) error {
+	var v json.RawMessage
+	return dec.Decode(&v)
+}
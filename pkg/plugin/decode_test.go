@@ -0,0 +1,219 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeString(t *testing.T, body string) *prometheusResponse {
+	t.Helper()
+	resp, err := decodeResponse(strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("decodeResponse: %v", err)
+	}
+	return resp
+}
+
+func samples(s promSeries) ([]time.Time, []float64) {
+	times := make([]time.Time, s.times.Len())
+	values := make([]float64, s.values.Len())
+	for i := range times {
+		times[i] = s.times.At(i).(time.Time)
+		values[i] = s.values.At(i).(float64)
+	}
+	return times, values
+}
+
+func TestDecodeMatrix(t *testing.T) {
+	resp := decodeString(t, `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"job":"node"},"values":[[1700000000.001,"1"],[1700000015,"2.5"]]},
+		{"metric":{"job":"prometheus"},"values":[]}
+	]}}`)
+
+	if resp.Status != "success" || resp.ResultType != "matrix" || len(resp.Series) != 2 {
+		t.Fatalf("got status %q, result type %q and %d series", resp.Status, resp.ResultType, len(resp.Series))
+	}
+	times, values := samples(resp.Series[0])
+	wantTimes := []time.Time{time.UnixMilli(1700000000001), time.UnixMilli(1700000015000)}
+	wantValues := []float64{1, 2.5}
+	for i := range wantTimes {
+		if !times[i].Equal(wantTimes[i]) || values[i] != wantValues[i] {
+			t.Errorf("sample %d: got %v %v, want %v %v", i, times[i], values[i], wantTimes[i], wantValues[i])
+		}
+	}
+	if resp.Series[0].labels["job"] != "node" {
+		t.Errorf("got labels %v", resp.Series[0].labels)
+	}
+	if n := resp.Series[1].times.Len(); n != 0 {
+		t.Errorf("empty series has %d samples", n)
+	}
+}
+
+func TestDecodeResultTypeAfterResult(t *testing.T) {
+	resp := decodeString(t, `{"data":{"result":[{"metric":{},"value":[1,"4"]}],"resultType":"vector"},"status":"success"}`)
+
+	if len(resp.Series) != 1 {
+		t.Fatalf("got %d series", len(resp.Series))
+	}
+	if _, values := samples(resp.Series[0]); len(values) != 1 || values[0] != 4 {
+		t.Errorf("got values %v", values)
+	}
+}
+
+func TestDecodeSpecialValues(t *testing.T) {
+	resp := decodeString(t, `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{},"values":[[1,"NaN"],[2,"+Inf"],[3,"-Inf"]]}
+	]}}`)
+
+	_, values := samples(resp.Series[0])
+	if len(values) != 3 || !math.IsNaN(values[0]) || !math.IsInf(values[1], 1) || !math.IsInf(values[2], -1) {
+		t.Errorf("got values %v, want NaN +Inf -Inf", values)
+	}
+}
+
+func TestDecodeInvalidSamples(t *testing.T) {
+	resp := decodeString(t, `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{},"values":[[1,"1"],[2,"bogus"],[3,3],[4,"4"]]}
+	]}}`)
+
+	s := resp.Series[0]
+	if _, values := samples(s); len(values) != 2 || values[0] != 1 || values[1] != 4 {
+		t.Errorf("got values %v, want [1 4]", values)
+	}
+	if s.invalid != 2 || len(s.notices()) != 1 {
+		t.Errorf("got %d invalid samples and notices %v", s.invalid, s.notices())
+	}
+}
+
+func TestDecodeScalar(t *testing.T) {
+	resp := decodeString(t, `{"status":"success","data":{"resultType":"scalar","result":[1700000000.5,"42"]}}`)
+
+	if len(resp.Series) != 1 {
+		t.Fatalf("got %d series", len(resp.Series))
+	}
+	s := resp.Series[0]
+	times, values := samples(s)
+	if len(values) != 1 || values[0] != 42 || !times[0].Equal(time.UnixMilli(1700000000500)) {
+		t.Errorf("got %v %v", times, values)
+	}
+	if s.labels == nil || len(s.labels) != 0 {
+		t.Errorf("got labels %v, want none", s.labels)
+	}
+}
+
+func TestDecodeString(t *testing.T) {
+	resp := decodeString(t, `{"status":"success","data":{"resultType":"string","result":[1700000000,"hello \"world\""]}}`)
+
+	if resp.String == nil {
+		t.Fatal("no string result")
+	}
+	if resp.String.value != `hello "world"` || !resp.String.time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("got %v %q", resp.String.time, resp.String.value)
+	}
+	if len(resp.Series) != 0 {
+		t.Errorf("got %d series", len(resp.Series))
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	resp := decodeString(t, `{"status":"error","errorType":"bad_data","error":"parse error"}`)
+
+	if resp.Status != "error" || resp.ErrorType != "bad_data" || resp.Error != "parse error" {
+		t.Errorf("got %+v", resp)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, body := range []string{
+		`<html>`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1,"1"],]}]}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[1]]}]}}`,
+		`{"status":"success","data":{"resultType":"string","result":[1]}}`,
+	} {
+		if _, err := decodeResponse(strings.NewReader(body)); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+func TestDecodeSizeLimit(t *testing.T) {
+	body := matrixBody(10, 100)
+
+	for _, limit := range []int{len(body) - 1, len(body) / 2} {
+		_, err := decodeResponse(&limitReader{r: strings.NewReader(body), n: int64(limit)})
+		if !errors.Is(err, errResponseTooLarge) {
+			t.Errorf("limit %d of %d bytes: got %v, want %v", limit, len(body), err, errResponseTooLarge)
+		}
+	}
+
+	resp, err := decodeResponse(&limitReader{r: strings.NewReader(body), n: int64(len(body))})
+	if err != nil {
+		t.Fatalf("response of exactly the limit: %v", err)
+	}
+	if len(resp.Series) != 10 {
+		t.Errorf("got %d series", len(resp.Series))
+	}
+}
+
+// matrixBody returns a range query response with n series of m samples.
+func matrixBody(n, m int) string {
+	var b strings.Builder
+	b.WriteString(`{"status":"success","data":{"resultType":"matrix","result":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"metric":{"__name__":"up","instance":"host-%d:9100","job":"node"},"values":[`, i)
+		for j := 0; j < m; j++ {
+			if j > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, `[%d.%03d,"%d.5"]`, 1700000000+j*15, j%1000, j)
+		}
+		b.WriteString("]}")
+	}
+	b.WriteString("]}}")
+	return b.String()
+}
+
+func BenchmarkDecodeStreaming(b *testing.B) {
+	body := matrixBody(5000, 240)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		resp, err := decodeResponse(strings.NewReader(body))
+		if err != nil || len(resp.Series) != 5000 {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeReadAll measures the previous decoding, which read the
+// whole body and unmarshalled the result into interface values.
+func BenchmarkDecodeReadAll(b *testing.B) {
+	body := matrixBody(5000, 240)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		raw, err := io.ReadAll(strings.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var resp struct {
+			Status string `json:"status"`
+			Data   struct {
+				ResultType string        `json:"resultType"`
+				Result     []interface{} `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(raw, &resp); err != nil || len(resp.Data.Result) != 5000 {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const exemplarsEndpoint = "/api/v1/query_exemplars"
+
+type exemplarResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   []struct {
+		SeriesLabels map[string]string `json:"seriesLabels"`
+		Exemplars    []struct {
+			Labels    map[string]string `json:"labels"`
+			Value     string            `json:"value"`
+			Timestamp float64           `json:"timestamp"`
+		} `json:"exemplars"`
+	} `json:"data"`
+}
+
+// queryExemplars returns the exemplars of expr in the query's time range as
+// a frame named "exemplar", which Grafana shows on the series of the same
+// refID. Failures do not fail the query; they are reported as a notice on
+// the frame.
+func (d *Datasource) queryExemplars(ctx context.Context, expr string, query backend.DataQuery) *data.Frame {
+	status := http.StatusOK
+	defer func(start time.Time) {
+		d.observeRequest("query_data", exemplarsEndpoint, status, start)
+	}(time.Now())
+
+	params := d.queryParams(expr)
+	params.Set("start", strconv.FormatInt(query.TimeRange.From.Unix(), 10))
+	params.Set("end", strconv.FormatInt(query.TimeRange.To.Unix(), 10))
+
+	er, err := d.fetchExemplars(ctx, params)
+	if err != nil {
+		status = http.StatusBadGateway
+		frame := exemplarFrame(nil, query.RefID)
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("failed to query exemplars: %v", err),
+		})
+		return frame
+	}
+	return exemplarFrame(er, query.RefID)
+}
+
+func (d *Datasource) fetchExemplars(ctx context.Context, params url.Values) (*exemplarResponse, error) {
+	httpReq, err := d.newPrometheusRequest(ctx, exemplarsEndpoint, params)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var er exemplarResponse
+	if err := json.NewDecoder(d.limitBody(resp.Body)).Decode(&er); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if er.Status != "success" {
+		return nil, errors.New(er.Error)
+	}
+	return &er, nil
+}
+
+// exemplarFrame returns one row per exemplar with its time, value and a
+// column for every series and exemplar label, such as the trace ID.
+func exemplarFrame(er *exemplarResponse, refID string) *data.Frame {
+	var names []string
+	seen := make(map[string]bool)
+	addNames := func(labels map[string]string) {
+		for name := range labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	var times []time.Time
+	var values []float64
+	var rows []map[string]string
+	invalid := 0
+	if er != nil {
+		for _, series := range er.Data {
+			addNames(series.SeriesLabels)
+			for _, e := range series.Exemplars {
+				v, err := strconv.ParseFloat(e.Value, 64)
+				if err != nil {
+					invalid++
+					continue
+				}
+				addNames(e.Labels)
+				labels := make(map[string]string, len(series.SeriesLabels)+len(e.Labels))
+				for k, v := range series.SeriesLabels {
+					labels[k] = v
+				}
+				for k, v := range e.Labels {
+					labels[k] = v
+				}
+				times = append(times, promTime(e.Timestamp))
+				values = append(values, v)
+				rows = append(rows, labels)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	frame := data.NewFrame("exemplar",
+		data.NewField("Time", nil, times),
+		data.NewField("Value", nil, values),
+	)
+	for _, name := range names {
+		column := make([]string, len(rows))
+		for i, labels := range rows {
+			column[i] = labels[name]
+		}
+		frame.Fields = append(frame.Fields, data.NewField(name, nil, column))
+	}
+	frame.RefID = refID
+	frame.Meta = &data.FrameMeta{Custom: map[string]string{"resultType": "exemplar"}}
+	if invalid > 0 {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("%d exemplar(s) with an invalid value were dropped", invalid),
+		})
+	}
+	return frame
+}
@@ -0,0 +1,214 @@
+package plugin
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// Query formats, see queryModel.Format.
+const (
+	formatTimeSeries = "time_series"
+	formatTable      = "table"
+	formatHeatmap    = "heatmap"
+)
+
+// promSeries is one series of a Prometheus query result.
+type promSeries struct {
+	labels map[string]string
+	// times and values are decoded into the fields of the series' frame,
+	// see newPromSeries.
+	times  *data.Field
+	values *data.Field
+	// Native histogram samples, held apart from the float samples since a
+	// series can have both.
+	histTimes  []time.Time
+	histograms []nativeHistogram
+	// invalid counts the samples dropped because they could not be parsed,
+	// invalidErr is the first such error.
+	invalid    int
+	invalidErr error
+}
+
+// newPromSeries returns a series with empty time and value fields.
+func newPromSeries() promSeries {
+	s := promSeries{
+		times:  data.NewFieldFromFieldType(data.FieldTypeTime, 0),
+		values: data.NewFieldFromFieldType(data.FieldTypeFloat64, 0),
+	}
+	s.times.Name = "time"
+	s.values.Name = "value"
+	return s
+}
+
+// notices reports dropped samples.
+func (s promSeries) notices() []data.Notice {
+	if s.invalid == 0 {
+		return nil
+	}
+	return []data.Notice{{
+		Severity: data.NoticeSeverityWarning,
+		Text:     fmt.Sprintf("%d sample(s) of %s could not be parsed and were dropped: %v", s.invalid, data.Labels(s.labels), s.invalidErr),
+	}}
+}
+
+// timeSeriesFrames returns one time/value frame per series.
+func timeSeriesFrames(series []promSeries, legendFormat, refID string) data.Frames {
+	frames := make(data.Frames, 0, len(series))
+	for _, s := range series {
+		s.values.Labels = s.labels
+		frame := data.NewFrame(formatLegend(s.labels, legendFormat), s.times, s.values)
+		frame.RefID = refID
+		addNotices(frame, s.notices())
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// tableFrame returns a single frame with a Time column, one column per label
+// and a Value column, holding one row per sample.
+func tableFrame(series []promSeries, refID string) *data.Frame {
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range series {
+		for name := range s.labels {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	rows := 0
+	for _, s := range series {
+		rows += s.times.Len()
+	}
+	times := data.NewFieldFromFieldType(data.FieldTypeTime, rows)
+	times.Name = "Time"
+	values := data.NewFieldFromFieldType(data.FieldTypeFloat64, rows)
+	values.Name = "Value"
+	columns := make([]*data.Field, len(names))
+	for i, name := range names {
+		columns[i] = data.NewFieldFromFieldType(data.FieldTypeString, rows)
+		columns[i].Name = name
+	}
+
+	row := 0
+	var notices []data.Notice
+	for _, s := range series {
+		notices = append(notices, s.notices()...)
+		for i := 0; i < s.times.Len(); i++ {
+			times.Set(row, s.times.At(i))
+			values.Set(row, s.values.At(i))
+			for j, name := range names {
+				columns[j].Set(row, s.labels[name])
+			}
+			row++
+		}
+	}
+
+	frame := data.NewFrame("", times)
+	frame.Fields = append(frame.Fields, columns...)
+	frame.Fields = append(frame.Fields, values)
+	frame.RefID = refID
+	frame.Meta = &data.FrameMeta{Type: data.FrameTypeTable}
+	addNotices(frame, notices)
+	return frame
+}
+
+// heatmapFrames converts cumulative histogram bucket series, identified by
+// their le label, into one frame per bucket ordered by upper bound, holding
+// the count of that bucket alone. Buckets of different histograms are
+// de-accumulated separately. Series without an le label are returned as
+// plain time series.
+func heatmapFrames(series []promSeries, legendFormat, refID string) data.Frames {
+	type bucket struct {
+		le float64
+		s  promSeries
+	}
+	var groups []string
+	buckets := make(map[string][]bucket)
+	var other []promSeries
+
+	for _, s := range series {
+		le, err := strconv.ParseFloat(s.labels["le"], 64)
+		if err != nil {
+			other = append(other, s)
+			continue
+		}
+		key := data.Labels(withoutLabel(s.labels, "le")).String()
+		if _, ok := buckets[key]; !ok {
+			groups = append(groups, key)
+		}
+		buckets[key] = append(buckets[key], bucket{le: le, s: s})
+	}
+	sort.Strings(groups)
+
+	bucketLegend := legendFormat
+	if bucketLegend == "" {
+		bucketLegend = "{{le}}"
+	}
+
+	var frames data.Frames
+	for _, key := range groups {
+		group := buckets[key]
+		sort.SliceStable(group, func(i, j int) bool { return group[i].le < group[j].le })
+
+		// Subtract the cumulative count of the next lower bucket at the
+		// same timestamp.
+		lower := make(map[int64]float64)
+		for _, b := range group {
+			n := b.s.values.Len()
+			values := data.NewFieldFromFieldType(data.FieldTypeFloat64, n)
+			values.Name = "value"
+			values.Labels = b.s.labels
+			next := make(map[int64]float64, n)
+			for i := 0; i < n; i++ {
+				ts := b.s.times.At(i).(time.Time).UnixMilli()
+				v := b.s.values.At(i).(float64)
+				values.Set(i, v-lower[ts])
+				next[ts] = v
+			}
+			lower = next
+
+			frame := data.NewFrame(formatLegend(b.s.labels, bucketLegend), b.s.times, values)
+			frame.RefID = refID
+			addNotices(frame, b.s.notices())
+			frames = append(frames, frame)
+		}
+	}
+
+	return append(frames, timeSeriesFrames(other, legendFormat, refID)...)
+}
+
+// addNotices appends notices to frame, leaving its metadata unset when there
+// are none.
+func addNotices(frame *data.Frame, notices []data.Notice) {
+	if len(notices) > 0 {
+		frame.AppendNotices(notices...)
+	}
+}
+
+// stringFrame returns the sample of a string result.
+func stringFrame(sample stringSample, refID string) *data.Frame {
+	frame := data.NewFrame("string",
+		data.NewField("time", nil, []time.Time{sample.time}),
+		data.NewField("value", nil, []string{sample.value}),
+	)
+	frame.RefID = refID
+	return frame
+}
+
+func withoutLabel(labels map[string]string, name string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != name {
+			out[k] = v
+		}
+	}
+	return out
+}
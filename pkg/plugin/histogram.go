@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// How native histogram samples are rendered, see queryModel.HistogramFormat.
+const (
+	// histogramFormatBuckets returns one heatmap cells frame per series.
+	histogramFormatBuckets = "buckets"
+	// histogramFormatCountSum returns the observation count and sum.
+	histogramFormatCountSum = "count_sum"
+)
+
+// frameTypeHeatmapCells is Grafana's frame type for pre-bucketed heatmap
+// data, which the plugin SDK does not define.
+const frameTypeHeatmapCells data.FrameType = "heatmap-cells"
+
+// nativeHistogram is a native histogram sample. The query API renders the
+// schema, zero bucket and positive and negative spans into explicit buckets,
+// ordered from the lowest bound upwards: negative buckets, the zero bucket
+// around 0 and then the positive buckets.
+type nativeHistogram struct {
+	count   float64
+	sum     float64
+	buckets []histogramBucket
+}
+
+type histogramBucket struct {
+	// boundary tells which bounds are inclusive: 0 open left, 1 open right,
+	// 2 open both, 3 closed both. The zero bucket is closed on both sides.
+	boundary int8
+	lower    float64
+	upper    float64
+	count    float64
+}
+
+// histogramArray decodes [[timestamp, {histogram}], ...] into a promSeries.
+type histogramArray promSeries
+
+func (a *histogramArray) UnmarshalJSON(b []byte) error {
+	var pairs []json.RawMessage
+	if err := json.Unmarshal(b, &pairs); err != nil {
+		return err
+	}
+	s := (*promSeries)(a)
+	s.histTimes = make([]time.Time, 0, len(pairs))
+	s.histograms = make([]nativeHistogram, 0, len(pairs))
+	for _, pair := range pairs {
+		if err := s.decodeHistogram(pair); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogramPair decodes a single [timestamp, {histogram}] into a promSeries.
+type histogramPair promSeries
+
+func (hp *histogramPair) UnmarshalJSON(b []byte) error {
+	return (*promSeries)(hp).decodeHistogram(b)
+}
+
+type histogramJSON struct {
+	Count   string              `json:"count"`
+	Sum     string              `json:"sum"`
+	Buckets [][]json.RawMessage `json:"buckets"`
+}
+
+// decodeHistogram appends a [timestamp, {histogram}] sample. Histograms
+// with unparseable numbers are counted and reported as a notice instead.
+func (s *promSeries) decodeHistogram(b []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return errMalformedSamples
+	}
+	var ts float64
+	if err := json.Unmarshal(pair[0], &ts); err != nil {
+		return err
+	}
+	var raw histogramJSON
+	if err := json.Unmarshal(pair[1], &raw); err != nil {
+		return err
+	}
+
+	h, err := parseHistogram(raw)
+	if err != nil {
+		s.addInvalid(err)
+		return nil
+	}
+	s.histTimes = append(s.histTimes, promTime(ts))
+	s.histograms = append(s.histograms, h)
+	return nil
+}
+
+func parseHistogram(raw histogramJSON) (nativeHistogram, error) {
+	var h nativeHistogram
+	var err error
+	if h.count, err = strconv.ParseFloat(raw.Count, 64); err != nil {
+		return h, fmt.Errorf("invalid histogram count %q", raw.Count)
+	}
+	if h.sum, err = strconv.ParseFloat(raw.Sum, 64); err != nil {
+		return h, fmt.Errorf("invalid histogram sum %q", raw.Sum)
+	}
+
+	h.buckets = make([]histogramBucket, 0, len(raw.Buckets))
+	for _, rb := range raw.Buckets {
+		if len(rb) != 4 {
+			return h, fmt.Errorf("malformed histogram bucket")
+		}
+		var boundary int8
+		var lower, upper, count string
+		if json.Unmarshal(rb[0], &boundary) != nil || json.Unmarshal(rb[1], &lower) != nil ||
+			json.Unmarshal(rb[2], &upper) != nil || json.Unmarshal(rb[3], &count) != nil {
+			return h, fmt.Errorf("malformed histogram bucket")
+		}
+
+		bucket := histogramBucket{boundary: boundary}
+		if bucket.lower, err = strconv.ParseFloat(lower, 64); err != nil {
+			return h, fmt.Errorf("invalid histogram bucket bound %q", lower)
+		}
+		if bucket.upper, err = strconv.ParseFloat(upper, 64); err != nil {
+			return h, fmt.Errorf("invalid histogram bucket bound %q", upper)
+		}
+		if bucket.count, err = strconv.ParseFloat(count, 64); err != nil {
+			return h, fmt.Errorf("invalid histogram bucket count %q", count)
+		}
+		h.buckets = append(h.buckets, bucket)
+	}
+	return h, nil
+}
+
+// histogramFrames renders the native histogram samples of series.
+func histogramFrames(series []promSeries, format, legendFormat, refID string) data.Frames {
+	var frames data.Frames
+	for _, s := range series {
+		var frame *data.Frame
+		if format == histogramFormatBuckets {
+			frame = histogramBucketFrame(s, legendFormat)
+		} else {
+			frame = histogramCountSumFrame(s, legendFormat)
+		}
+		frame.RefID = refID
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// histogramBucketFrame returns a heatmap cells frame with one row per bucket
+// and sample, in the layout Grafana's heatmap panel reads directly.
+func histogramBucketFrame(s promSeries, legendFormat string) *data.Frame {
+	n := 0
+	for _, h := range s.histograms {
+		n += len(h.buckets)
+	}
+	xMax := make([]time.Time, 0, n)
+	yMin := make([]float64, 0, n)
+	yMax := make([]float64, 0, n)
+	counts := make([]float64, 0, n)
+	layout := make([]int8, 0, n)
+	for i, h := range s.histograms {
+		for _, b := range h.buckets {
+			xMax = append(xMax, s.histTimes[i])
+			yMin = append(yMin, b.lower)
+			yMax = append(yMax, b.upper)
+			counts = append(counts, b.count)
+			layout = append(layout, b.boundary)
+		}
+	}
+
+	frame := data.NewFrame(formatLegend(s.labels, legendFormat),
+		data.NewField("xMax", nil, xMax),
+		data.NewField("yMin", nil, yMin),
+		data.NewField("yMax", nil, yMax),
+		data.NewField("count", s.labels, counts),
+		data.NewField("yLayout", nil, layout),
+	)
+	frame.Meta = &data.FrameMeta{Type: frameTypeHeatmapCells}
+	addNotices(frame, s.notices())
+	return frame
+}
+
+// histogramCountSumFrame returns the observation count and sum over time.
+func histogramCountSumFrame(s promSeries, legendFormat string) *data.Frame {
+	counts := make([]float64, len(s.histograms))
+	sums := make([]float64, len(s.histograms))
+	for i, h := range s.histograms {
+		counts[i] = h.count
+		sums[i] = h.sum
+	}
+
+	frame := data.NewFrame(formatLegend(s.labels, legendFormat),
+		data.NewField("time", nil, s.histTimes),
+		data.NewField("count", s.labels, counts),
+		data.NewField("sum", s.labels, sums),
+	)
+	addNotices(frame, s.notices())
+	return frame
+}
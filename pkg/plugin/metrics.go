@@ -0,0 +1,132 @@
+package plugin
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/tobiasworkstech/ssh-prometheus-datasource/pkg/ssh"
+)
+
+// requestDuration and the tunnel metrics of the ssh package are registered
+// with the default registry, which the plugin SDK exposes through the plugin
+// metrics endpoint.
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "sshprometheus",
+	Name:      "request_duration_seconds",
+	Help:      "Duration of QueryData queries and CallResource calls by Prometheus endpoint and status code.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"datasource_uid", "handler", "endpoint", "status"})
+
+func (d *Datasource) observeRequest(handler, endpoint string, status int, start time.Time) {
+	requestDuration.WithLabelValues(d.uid, handler, endpoint, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+}
+
+// metricsRefs counts the instances of each datasource UID. When a datasource
+// is re-saved, the SDK creates the new instance before it disposes the old
+// one, and both report under the same UID.
+var metricsRefs = struct {
+	sync.Mutex
+	n map[string]int
+}{n: make(map[string]int)}
+
+func retainMetrics(uid string) {
+	metricsRefs.Lock()
+	defer metricsRefs.Unlock()
+	metricsRefs.n[uid]++
+}
+
+// releaseMetrics removes the series of the datasource from the request and
+// tunnel metrics once its last instance is disposed.
+func releaseMetrics(uid string) {
+	metricsRefs.Lock()
+	defer metricsRefs.Unlock()
+	if metricsRefs.n[uid]--; metricsRefs.n[uid] > 0 {
+		return
+	}
+	delete(metricsRefs.n, uid)
+	requestDuration.DeletePartialMatch(prometheus.Labels{"datasource_uid": uid})
+	ssh.DeleteMetrics(uid)
+}
+
+// dataResponseStatus returns the HTTP status code equivalent of res.
+func dataResponseStatus(res backend.DataResponse) int {
+	switch {
+	case res.Status != 0:
+		return int(res.Status)
+	case res.Error != nil:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusOK
+	}
+}
+
+// prometheusEndpoints are the Prometheus API paths reported as their own
+// endpoint label by resourceEndpoint.
+var prometheusEndpoints = map[string]bool{
+	"api/v1/query":              true,
+	"api/v1/query_range":        true,
+	"api/v1/query_exemplars":    true,
+	"api/v1/format_query":       true,
+	"api/v1/parse_query":        true,
+	"api/v1/series":             true,
+	"api/v1/labels":             true,
+	"api/v1/label/:name/values": true,
+	"api/v1/metadata":           true,
+	"api/v1/targets":            true,
+	"api/v1/targets/metadata":   true,
+	"api/v1/rules":              true,
+	"api/v1/alerts":             true,
+	"api/v1/alertmanagers":      true,
+	"api/v1/status/config":      true,
+	"api/v1/status/flags":       true,
+	"api/v1/status/runtimeinfo": true,
+	"api/v1/status/buildinfo":   true,
+	"api/v1/status/tsdb":        true,
+	"api/v1/status/walreplay":   true,
+}
+
+// resourceEndpoint returns the metric label for a resource path. Only the
+// plugin's own endpoints, known Prometheus API paths and configured target
+// names are used as labels; label names in paths are replaced by a
+// placeholder and any other path is reported as "other", so that callers
+// cannot create an unbounded number of series.
+func (d *Datasource) resourceEndpoint(path string) string {
+	path = strings.Trim(path, "/")
+	switch path {
+	case "test-ssh", "pool-stats", "validate-key":
+		return path
+	}
+
+	parts := strings.Split(path, "/")
+	if _, ok := d.targets[parts[0]]; ok {
+		return parts[0]
+	}
+	// api/v1/label/<name>/values
+	if len(parts) == 5 && parts[0] == "api" && parts[2] == "label" && parts[4] == "values" {
+		parts[3] = ":name"
+	}
+	if endpoint := strings.Join(parts, "/"); prometheusEndpoints[endpoint] {
+		return endpoint
+	}
+	return "other"
+}
+
+// statusRecorder remembers the status code of the first response sent.
+type statusRecorder struct {
+	backend.CallResourceResponseSender
+	status int
+}
+
+func (s *statusRecorder) Send(resp *backend.CallResourceResponse) error {
+	if s.status == 0 {
+		s.status = resp.Status
+	}
+	return s.CallResourceResponseSender.Send(resp)
+}
@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+
+	"github.com/tobiasworkstech/ssh-prometheus-datasource/pkg/ssh"
+)
+
+// reservedTargetNames are resource paths that cannot be used as target names.
+var reservedTargetNames = map[string]bool{
+	"api":          true,
+	"test-ssh":     true,
+	"pool-stats":   true,
+	"validate-key": true,
+}
+
+// forwardTarget is a named service reached over the datasource's tunnel.
+type forwardTarget struct {
+	name   string
+	url    prometheusTarget
+	client *http.Client
+}
+
+func (t *forwardTarget) baseURL() string {
+	return fmt.Sprintf("%s://%s%s", t.url.scheme, t.url.host, t.url.pathPrefix)
+}
+
+// newForwardTargets validates the configured targets and creates an HTTP
+// client for each of them. Target connections are always dialed over the SSH
+// connection, also when Prometheus uses the local listener.
+func (d *Datasource) newForwardTargets(tlsConfig *tls.Config) (map[string]*forwardTarget, error) {
+	targets := make(map[string]*forwardTarget, len(d.settings.Targets))
+	for _, ts := range d.settings.Targets {
+		if ts.Name == "" || strings.Contains(ts.Name, "/") || reservedTargetNames[ts.Name] {
+			return nil, fmt.Errorf("invalid target name %q", ts.Name)
+		}
+		if _, ok := targets[ts.Name]; ok {
+			return nil, fmt.Errorf("duplicate target name %q", ts.Name)
+		}
+
+		target, err := parseTargetURL(ts.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL of target %q: %w", ts.Name, err)
+		}
+
+		name := ts.Name
+		transport := &http.Transport{
+			TLSClientConfig: tlsConfig,
+			IdleConnTimeout: d.idleConnTimeout(),
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.dialTarget(ctx, name)
+			},
+		}
+		targets[name] = &forwardTarget{
+			name: name,
+			url:  target,
+			client: &http.Client{
+				Timeout:   time.Duration(d.settings.Timeout) * time.Second,
+				Transport: transport,
+			},
+		}
+	}
+	return targets, nil
+}
+
+// parseTargetURL parses a target URL like the Prometheus URL and keeps the
+// path of http and https URLs as path prefix.
+func parseTargetURL(rawURL string) (prometheusTarget, error) {
+	target, err := parsePrometheusURL(rawURL)
+	if err != nil {
+		return target, err
+	}
+	if target.socket == "" {
+		u, _ := url.Parse(rawURL)
+		target.pathPrefix = strings.TrimRight(u.Path, "/")
+	}
+	return target, nil
+}
+
+// tunnelTargets returns the forward targets of the tunnel configuration.
+func (d *Datasource) tunnelTargets() map[string]ssh.Target {
+	if len(d.targets) == 0 {
+		return nil
+	}
+	targets := make(map[string]ssh.Target, len(d.targets))
+	for name, t := range d.targets {
+		targets[name] = ssh.Target{Host: t.url.remoteHost, Port: t.url.remotePort, Socket: t.url.socket}
+	}
+	return targets
+}
+
+func (d *Datasource) dialTarget(ctx context.Context, name string) (net.Conn, error) {
+	d.tunnelMu.Lock()
+	tunnel := d.tunnel
+	d.tunnelMu.Unlock()
+
+	if tunnel == nil {
+		return nil, fmt.Errorf("SSH tunnel is not established")
+	}
+	return tunnel.DialTarget(ctx, name)
+}
+
+// closeIdleConnections closes the kept-alive HTTP connections of Prometheus
+// and every target.
+func (d *Datasource) closeIdleConnections() {
+	d.httpClient.CloseIdleConnections()
+	for _, t := range d.targets {
+		t.client.CloseIdleConnections()
+	}
+}
+
+// closeIdleConnectionsUntil keeps closing idle kept-alive connections until
+// done is closed. While a tunnel drains, requests that finish return their
+// connection to the pool, where it would keep its channel open until the
+// drain timeout forces it closed.
+func (d *Datasource) closeIdleConnectionsUntil(done <-chan struct{}) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		d.closeIdleConnections()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// matchTarget returns the target whose name is the first segment of the
+// resource path, together with the rest of the path including the query.
+func (d *Datasource) matchTarget(req *backend.CallResourceRequest) (*forwardTarget, string, bool) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(req.Path, "/"), "/")
+	target, ok := d.targets[name]
+	if !ok {
+		return nil, "", false
+	}
+
+	path := req.Path
+	if len(req.URL) > len(req.Path) {
+		path = req.URL
+	}
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "/"), name)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return target, path, true
+}
+
+// callTarget relays a resource call to a target. Unlike Prometheus API
+// calls, the body is passed on unchanged and no Prometheus credentials are
+// added.
+func (d *Datasource) callTarget(ctx context.Context, target *forwardTarget, path string, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, target.baseURL()+path, bytes.NewReader(req.Body))
+	if err != nil {
+		return sender.Send(&backend.CallResourceResponse{
+			Status: http.StatusInternalServerError,
+			Body:   []byte(fmt.Sprintf(`{"error": "%s"}`, err.Error())),
+		})
+	}
+
+	for k, v := range req.Headers {
+		for _, val := range v {
+			httpReq.Header.Add(k, val)
+		}
+	}
+
+	return sendResourceResponse(target.client, httpReq, sender)
+}
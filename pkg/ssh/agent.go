@@ -0,0 +1,126 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AgentKey describes a key offered by the SSH agent.
+type AgentKey struct {
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+	Comment     string `json:"comment,omitempty"`
+	Accepted    bool   `json:"accepted"`
+}
+
+// agentAuth authenticates with the keys held by an ssh-agent listening on a
+// Unix socket. The agent connection has to stay open until the handshake is
+// done, so callers must Close it once the hop is connected.
+type agentAuth struct {
+	conn net.Conn
+	keys []AgentKey
+	mu   sync.Mutex
+}
+
+func newAgentAuth(socket string) (*agentAuth, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, fmt.Errorf("no SSH agent socket configured and SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SSH agent at %s: %w", socket, err)
+	}
+
+	return &agentAuth{conn: conn}, nil
+}
+
+// method returns an auth method that offers every agent key in turn and
+// records which one the server accepted.
+func (a *agentAuth) method() ssh.AuthMethod {
+	client := agent.NewClient(a.conn)
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		keys, err := client.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list SSH agent keys: %w", err)
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("SSH agent has no keys")
+		}
+
+		signers, err := client.Signers()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get SSH agent signers: %w", err)
+		}
+
+		a.mu.Lock()
+		a.keys = make([]AgentKey, 0, len(keys))
+		for _, k := range keys {
+			a.keys = append(a.keys, AgentKey{
+				Type:        k.Format,
+				Fingerprint: ssh.FingerprintSHA256(k),
+				Comment:     k.Comment,
+			})
+		}
+		a.mu.Unlock()
+
+		wrapped := make([]ssh.Signer, 0, len(signers))
+		for _, signer := range signers {
+			wrapped = append(wrapped, &recordingSigner{Signer: signer, agent: a})
+		}
+		return wrapped, nil
+	})
+}
+
+// Keys returns the keys listed by the agent during the last handshake.
+func (a *agentAuth) Keys() []AgentKey {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AgentKey(nil), a.keys...)
+}
+
+func (a *agentAuth) Close() error {
+	return a.conn.Close()
+}
+
+// markAccepted flags the key the server asked us to sign with. The client only
+// signs after the server has accepted the public key, so the last key signed
+// with is the one authentication succeeded with.
+func (a *agentAuth) markAccepted(pub ssh.PublicKey) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	fingerprint := ssh.FingerprintSHA256(pub)
+	for i := range a.keys {
+		a.keys[i].Accepted = a.keys[i].Fingerprint == fingerprint
+	}
+}
+
+type recordingSigner struct {
+	ssh.Signer
+	agent *agentAuth
+}
+
+func (s *recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.agent.markAccepted(s.PublicKey())
+	return s.Signer.Sign(rand, data)
+}
+
+// SignWithAlgorithm keeps rsa-sha2 signatures available for RSA agent keys.
+func (s *recordingSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.agent.markAccepted(s.PublicKey())
+	if as, ok := s.Signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return s.Signer.Sign(rand, data)
+}
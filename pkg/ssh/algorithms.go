@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithm presets for AlgorithmPolicy.Preset. An empty preset uses the
+// defaults of golang.org/x/crypto/ssh.
+const (
+	AlgorithmPresetModern = "modern"
+	AlgorithmPresetFIPS   = "fips"
+	AlgorithmPresetLegacy = "legacy"
+)
+
+// AlgorithmPolicy restricts the algorithms offered during the SSH handshake.
+// Each non-empty list replaces the corresponding list of the preset, in
+// preference order.
+type AlgorithmPolicy struct {
+	Preset       string
+	KeyExchanges []string
+	Ciphers      []string
+	MACs         []string
+	HostKeys     []string
+}
+
+var algorithmPresets = map[string]ssh.Algorithms{
+	AlgorithmPresetModern: {
+		KeyExchanges: []string{
+			ssh.KeyExchangeMLKEM768X25519,
+			ssh.KeyExchangeCurve25519,
+			ssh.KeyExchangeECDHP256,
+			ssh.KeyExchangeECDHP384,
+			ssh.KeyExchangeECDHP521,
+		},
+		Ciphers: []string{
+			ssh.CipherChaCha20Poly1305,
+			ssh.CipherAES256GCM,
+			ssh.CipherAES128GCM,
+		},
+		MACs: []string{
+			ssh.HMACSHA512ETM,
+			ssh.HMACSHA256ETM,
+		},
+		HostKeys: []string{
+			ssh.CertAlgoED25519v01,
+			ssh.CertAlgoECDSA256v01,
+			ssh.CertAlgoECDSA384v01,
+			ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01,
+			ssh.CertAlgoRSASHA256v01,
+			ssh.KeyAlgoED25519,
+			ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoECDSA384,
+			ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512,
+			ssh.KeyAlgoRSASHA256,
+		},
+	},
+	// FIPS 140 approved algorithms only: NIST curves and SHA-2, no
+	// Curve25519, ChaCha20 or Ed25519.
+	AlgorithmPresetFIPS: {
+		KeyExchanges: []string{
+			ssh.KeyExchangeECDHP256,
+			ssh.KeyExchangeECDHP384,
+			ssh.KeyExchangeECDHP521,
+			ssh.KeyExchangeDH16SHA512,
+			ssh.KeyExchangeDH14SHA256,
+		},
+		Ciphers: []string{
+			ssh.CipherAES256GCM,
+			ssh.CipherAES128GCM,
+			ssh.CipherAES256CTR,
+			ssh.CipherAES192CTR,
+			ssh.CipherAES128CTR,
+		},
+		MACs: []string{
+			ssh.HMACSHA512ETM,
+			ssh.HMACSHA256ETM,
+			ssh.HMACSHA512,
+			ssh.HMACSHA256,
+		},
+		HostKeys: []string{
+			ssh.CertAlgoECDSA256v01,
+			ssh.CertAlgoECDSA384v01,
+			ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01,
+			ssh.CertAlgoRSASHA256v01,
+			ssh.KeyAlgoECDSA256,
+			ssh.KeyAlgoECDSA384,
+			ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512,
+			ssh.KeyAlgoRSASHA256,
+		},
+	},
+	// Everything implemented, with the insecure algorithms last so they are
+	// only used when the server offers nothing better.
+	AlgorithmPresetLegacy: {
+		KeyExchanges: slices.Concat(ssh.SupportedAlgorithms().KeyExchanges, ssh.InsecureAlgorithms().KeyExchanges),
+		Ciphers:      slices.Concat(ssh.SupportedAlgorithms().Ciphers, ssh.InsecureAlgorithms().Ciphers),
+		MACs:         slices.Concat(ssh.SupportedAlgorithms().MACs, ssh.InsecureAlgorithms().MACs),
+		HostKeys:     slices.Concat(ssh.SupportedAlgorithms().HostKeys, ssh.InsecureAlgorithms().HostKeys),
+	},
+}
+
+// resolve returns the algorithms to offer. Nil lists leave the library
+// defaults in place.
+func (p AlgorithmPolicy) resolve() (ssh.Algorithms, error) {
+	var algos ssh.Algorithms
+	if p.Preset != "" {
+		preset, ok := algorithmPresets[p.Preset]
+		if !ok {
+			return algos, fmt.Errorf("unknown algorithm preset %q", p.Preset)
+		}
+		algos = preset
+	}
+
+	supported := ssh.SupportedAlgorithms()
+	insecure := ssh.InsecureAlgorithms()
+	lists := []struct {
+		kind      string
+		allowed   []string
+		dst       *[]string
+		supported []string
+		insecure  []string
+	}{
+		{"key exchange", p.KeyExchanges, &algos.KeyExchanges, supported.KeyExchanges, insecure.KeyExchanges},
+		{"cipher", p.Ciphers, &algos.Ciphers, supported.Ciphers, insecure.Ciphers},
+		{"MAC", p.MACs, &algos.MACs, supported.MACs, insecure.MACs},
+		{"host key", p.HostKeys, &algos.HostKeys, supported.HostKeys, insecure.HostKeys},
+	}
+	for _, l := range lists {
+		if len(l.allowed) == 0 {
+			continue
+		}
+		for _, name := range l.allowed {
+			if !slices.Contains(l.supported, name) && !slices.Contains(l.insecure, name) {
+				return algos, fmt.Errorf("unsupported %s algorithm %q", l.kind, name)
+			}
+		}
+		*l.dst = l.allowed
+	}
+
+	return algos, nil
+}
+
+// NegotiatedAlgorithms describes the algorithms agreed on with an SSH server.
+// Cipher and MAC are those of the client to server direction; the MAC is
+// empty for AEAD ciphers.
+type NegotiatedAlgorithms struct {
+	KeyExchange string `json:"keyExchange"`
+	HostKey     string `json:"hostKey"`
+	Cipher      string `json:"cipher"`
+	MAC         string `json:"mac,omitempty"`
+}
+
+func negotiatedAlgorithms(conn ssh.Conn) *NegotiatedAlgorithms {
+	meta, ok := conn.(ssh.AlgorithmsConnMetadata)
+	if !ok {
+		return nil
+	}
+	algos := meta.Algorithms()
+	return &NegotiatedAlgorithms{
+		KeyExchange: algos.KeyExchange,
+		HostKey:     algos.HostKey,
+		Cipher:      algos.Write.Cipher,
+		MAC:         algos.Write.MAC,
+	}
+}
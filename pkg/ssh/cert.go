@@ -0,0 +1,79 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parseCertificate parses an OpenSSH certificate as found in an
+// id_ed25519-cert.pub file.
+func parseCertificate(data string) (*ssh.Certificate, error) {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("key of type %s is not a certificate", pub.Type())
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate is not a user certificate")
+	}
+
+	return cert, nil
+}
+
+// certSigner attaches a user certificate to signer after checking that the
+// certificate belongs to the key and is currently valid.
+func certSigner(certificate string, signer ssh.Signer, now time.Time) (ssh.Signer, error) {
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, fmt.Errorf("certificate does not match the private key")
+	}
+
+	if err := checkCertificateValidity(cert, now); err != nil {
+		return nil, err
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+func checkCertificateValidity(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("certificate is not valid before %s", time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("certificate expired at %s", certificateExpiry(cert).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// certificateExpiry returns when cert expires, or the zero time if it never
+// does.
+func certificateExpiry(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore == ssh.CertTimeInfinity || cert.ValidBefore > uint64(1<<63-1) {
+		return time.Time{}
+	}
+	return time.Unix(int64(cert.ValidBefore), 0).UTC()
+}
+
+// CertificateExpiry returns when the given OpenSSH user certificate expires.
+// The zero time is returned for certificates that never expire.
+func CertificateExpiry(certificate string) (time.Time, error) {
+	cert, err := parseCertificate(certificate)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return certificateExpiry(cert), nil
+}
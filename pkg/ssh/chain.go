@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HopError reports which hop of the SSH chain failed.
+type HopError struct {
+	// Index is the zero based position of the hop in TunnelConfig.Hops.
+	Index int
+	Host  string
+	Err   error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("hop %d (%s): %v", e.Index+1, e.Host, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+// HopInfo describes how a hop of the chain was authenticated and which
+// algorithms were negotiated with it. HostKey is the SHA256 fingerprint of
+// the host key the server presented, whether or not it was accepted, so that
+// a key trusted on first use can be pinned.
+type HopInfo struct {
+	Host          string                `json:"host"`
+	HostKey       string                `json:"hostKey,omitempty"`
+	HostKeyPolicy string                `json:"hostKeyPolicy"`
+	AgentKeys     []AgentKey            `json:"agentKeys,omitempty"`
+	Algorithms    *NegotiatedAlgorithms `json:"algorithms,omitempty"`
+}
+
+// ConnectionInfo collects details about a connection attempt.
+type ConnectionInfo struct {
+	Hops []HopInfo `json:"hops"`
+}
+
+func clientConfig(hop HopConfig, auth *hopAuth) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := buildHostKeyCallback(hop)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build host key verification: %w", err)
+	}
+
+	algos, err := hop.Algorithms.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:              hop.SSHUsername,
+		Auth:              auth.methods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algos.HostKeys,
+	}
+	config.KeyExchanges = algos.KeyExchanges
+	config.Ciphers = algos.Ciphers
+	config.MACs = algos.MACs
+	return config, nil
+}
+
+// dialChain connects to every hop of the configuration in order, dialing each
+// hop through the client of the previous one. Each hop, including its
+// handshake, has to complete within timeout, and the whole chain is aborted
+// when ctx is done. The returned clients are in dial order, so the last one
+// is connected to the SSH server itself. If info is not nil, details about
+// every attempted hop are appended to it.
+func dialChain(ctx context.Context, config TunnelConfig, timeout time.Duration, info *ConnectionInfo) ([]*ssh.Client, error) {
+	hops := config.Hops()
+	clients := make([]*ssh.Client, 0, len(hops))
+
+	for i, hop := range hops {
+		hopInfo := HopInfo{Host: hop.addr(), HostKeyPolicy: hop.HostKeyPolicy}
+		if hopInfo.HostKeyPolicy == "" {
+			hopInfo.HostKeyPolicy = HostKeyPolicyTOFU
+		}
+		hopCtx, cancel := context.WithTimeout(ctx, timeout)
+		client, err := dialHop(hopCtx, config.Proxy, clients, hop, &hopInfo)
+		cancel()
+		if info != nil {
+			info.Hops = append(info.Hops, hopInfo)
+		}
+		if err != nil {
+			closeChain(clients)
+			return nil, &HopError{Index: i, Host: hop.addr(), Err: err}
+		}
+		clients = append(clients, client)
+	}
+
+	return clients, nil
+}
+
+func dialHop(ctx context.Context, proxy ProxyConfig, previous []*ssh.Client, hop HopConfig, info *HopInfo) (*ssh.Client, error) {
+	auth, err := buildAuthMethods(hop)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build auth methods: %w", err)
+	}
+	defer func() {
+		if auth.agent != nil {
+			info.AgentKeys = auth.agent.Keys()
+		}
+		auth.Close()
+	}()
+
+	sshConfig, err := clientConfig(hop, auth)
+	if err != nil {
+		return nil, err
+	}
+	verify := sshConfig.HostKeyCallback
+	sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		info.HostKey = ssh.FingerprintSHA256(key)
+		return verify(hostname, remote, key)
+	}
+
+	addr := hop.addr()
+
+	var conn net.Conn
+	switch {
+	case len(previous) > 0:
+		conn, err = previous[len(previous)-1].DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial through previous hop: %w", err)
+		}
+	case proxy.Type != "":
+		conn, err = dialProxy(ctx, proxy, addr)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The handshake has no context of its own, so closing the connection is
+	// what aborts it.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("SSH handshake aborted: %w", ctx.Err())
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	info.Algorithms = negotiatedAlgorithms(c)
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeChain closes the clients of a chain from the innermost hop outwards.
+func closeChain(clients []*ssh.Client) error {
+	var firstErr error
+	for i := len(clients) - 1; i >= 0; i-- {
+		if err := clients[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,99 @@
+package ssh
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// channelSet tracks the open channels of a tunnel, so that closing the tunnel
+// can wait for them.
+type channelSet struct {
+	mu      sync.Mutex
+	conns   map[*trackedConn]struct{}
+	closed  bool
+	drained chan struct{}
+}
+
+// add tracks conn. It returns nil once the set is closed, in which case the
+// caller must close conn itself.
+func (s *channelSet) add(conn net.Conn) net.Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	if s.conns == nil {
+		s.conns = make(map[*trackedConn]struct{})
+	}
+	tc := &trackedConn{Conn: conn, set: s}
+	s.conns[tc] = struct{}{}
+	return tc
+}
+
+// len returns the number of open channels.
+func (s *channelSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *channelSet) remove(tc *trackedConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, tc)
+	if len(s.conns) == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// drain refuses new channels, waits up to grace for the open ones to be
+// closed and then closes the remaining ones. It returns how many channels
+// were open when draining started and how many had to be closed.
+func (s *channelSet) drain(grace time.Duration) (open, forced int) {
+	s.mu.Lock()
+	s.closed = true
+	open = len(s.conns)
+	var drained chan struct{}
+	if open > 0 && grace > 0 {
+		drained = make(chan struct{})
+		s.drained = drained
+	}
+	s.mu.Unlock()
+
+	if drained != nil {
+		timer := time.NewTimer(grace)
+		select {
+		case <-drained:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	s.mu.Lock()
+	remaining := make([]*trackedConn, 0, len(s.conns))
+	for tc := range s.conns {
+		remaining = append(remaining, tc)
+	}
+	s.drained = nil
+	s.mu.Unlock()
+
+	for _, tc := range remaining {
+		tc.Close()
+	}
+	return open, len(remaining)
+}
+
+type trackedConn struct {
+	net.Conn
+	set  *channelSet
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() { c.set.remove(c) })
+	return c.Conn.Close()
+}
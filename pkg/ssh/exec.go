@@ -0,0 +1,231 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Transports for TunnelConfig.Transport.
+const (
+	// TransportAuto forwards connections and falls back to TransportExec
+	// when the SSH server refuses port forwarding.
+	TransportAuto    = "auto"
+	TransportForward = "forward"
+	TransportExec    = "exec"
+)
+
+// Default relay commands, which connect stdin and stdout to the target with
+// netcat. In exec commands {host}, {port} and {socket} are replaced by the
+// shell quoted target.
+const (
+	DefaultExecCommand       = "nc {host} {port}"
+	DefaultExecSocketCommand = "nc -U {socket}"
+)
+
+// execStderrLimit is how much of a relay command's stderr is kept for logs.
+const execStderrLimit = 4096
+
+// dialRemote opens a connection to target with the configured transport.
+func (t *Tunnel) dialRemote(ctx context.Context, client *ssh.Client, target Target) (net.Conn, error) {
+	if t.config.Transport == TransportExec || t.execFallback.Load() {
+		return dialExec(ctx, client, t.config.ExecCommand, target)
+	}
+
+	network, addr := target.remote()
+	conn, err := client.DialContext(ctx, network, addr)
+	if err == nil || t.config.Transport == TransportForward {
+		return conn, err
+	}
+
+	var chanErr *ssh.OpenChannelError
+	if !errors.As(err, &chanErr) || chanErr.Reason != ssh.Prohibited {
+		return nil, err
+	}
+	if t.execFallback.CompareAndSwap(false, true) {
+		log.DefaultLogger.Warn("SSH server refused port forwarding, falling back to exec transport", "host", t.Endpoint(), "error", err)
+	}
+	return dialExec(ctx, client, t.config.ExecCommand, target)
+}
+
+// Transport returns the transport connections currently use, TransportForward
+// or TransportExec.
+func (t *Tunnel) Transport() string {
+	if t.config.Transport == TransportExec || t.execFallback.Load() {
+		return TransportExec
+	}
+	return TransportForward
+}
+
+// execCommand fills the placeholders of command with the shell quoted target.
+func execCommand(command string, target Target) string {
+	if command == "" {
+		command = DefaultExecCommand
+		if target.Socket != "" {
+			command = DefaultExecSocketCommand
+		}
+	}
+	port := ""
+	if target.Socket == "" {
+		port = strconv.Itoa(target.Port)
+	}
+	return strings.NewReplacer(
+		"{host}", shellQuote(target.Host),
+		"{port}", shellQuote(port),
+		"{socket}", shellQuote(target.Socket),
+	).Replace(command)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// dialExec runs the relay command in an exec session and returns a
+// connection whose reads and writes are the command's stdout and stdin. It
+// gives up when ctx is done, like ssh.Client.DialContext, and closes the
+// session once it is no longer wanted.
+func dialExec(ctx context.Context, client *ssh.Client, command string, target Target) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type connErr struct {
+		conn *execConn
+		err  error
+	}
+	ch := make(chan connErr)
+	go func() {
+		conn, err := startExec(ctx, client, command, target)
+		select {
+		case ch <- connErr{conn, err}:
+		case <-ctx.Done():
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return res.conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func startExec(ctx context.Context, client *ssh.Client, command string, target Target) (*execConn, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open exec session: %w", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stderr := &limitedBuffer{limit: execStderrLimit}
+	session.Stderr = stderr
+
+	cmd := execCommand(command, target)
+	// Closing the session is what aborts a pending start.
+	stop := context.AfterFunc(ctx, func() { session.Close() })
+	err = session.Start(cmd)
+	if !stop() {
+		session.Close()
+		return nil, fmt.Errorf("relay command aborted: %w", ctx.Err())
+	}
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start relay command: %w", err)
+	}
+
+	conn := &execConn{session: session, stdin: stdin, stdout: stdout, addr: execAddr(cmd)}
+	go func() {
+		// Closing the session ourselves ends the command without a status.
+		err := session.Wait()
+		var missing *ssh.ExitMissingError
+		if err != nil && !(errors.As(err, &missing) && conn.closed.Load()) {
+			log.DefaultLogger.Warn("SSH relay command failed", "command", cmd, "error", err, "stderr", stderr.String())
+		}
+	}()
+
+	return conn, nil
+}
+
+// execConn is a net.Conn over the stdin and stdout of an exec session.
+type execConn struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+	addr    execAddr
+	closed  atomic.Bool
+}
+
+func (c *execConn) Read(p []byte) (int, error)  { return c.stdout.Read(p) }
+func (c *execConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+func (c *execConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	c.stdin.Close()
+	if err := c.session.Close(); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+func (c *execConn) LocalAddr() net.Addr  { return c.addr }
+func (c *execConn) RemoteAddr() net.Addr { return c.addr }
+
+// Deadlines are not supported, the same as for forwarded SSH channels.
+func (c *execConn) SetDeadline(time.Time) error      { return errExecDeadline }
+func (c *execConn) SetReadDeadline(time.Time) error  { return errExecDeadline }
+func (c *execConn) SetWriteDeadline(time.Time) error { return errExecDeadline }
+
+var errExecDeadline = errors.New("ssh: exec session: deadline not supported")
+
+type execAddr string
+
+func (a execAddr) Network() string { return "ssh-exec" }
+func (a execAddr) String() string  { return string(a) }
+
+// limitedBuffer keeps the first limit bytes written to it.
+type limitedBuffer struct {
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.TrimSpace(b.buf.String())
+}
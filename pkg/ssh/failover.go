@@ -0,0 +1,246 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Strategies for choosing between the SSH host endpoints.
+const (
+	StrategyFailover = "failover"
+	StrategyRandom   = "random"
+	StrategyLatency  = "latency"
+)
+
+// DefaultEndpointCooldown is how long a failed SSH host is skipped.
+const DefaultEndpointCooldown = time.Minute
+
+// latencyWeight is the weight of a new sample in the latency moving average.
+const latencyWeight = 0.3
+
+// Endpoint is an alternative address for the SSH host.
+type Endpoint struct {
+	Host string
+	Port int
+}
+
+func (e Endpoint) addr() string {
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// EndpointState describes what is known about an SSH host endpoint.
+type EndpointState struct {
+	Address        string     `json:"address"`
+	Healthy        bool       `json:"healthy"`
+	Connected      bool       `json:"connected"`
+	UnhealthyUntil *time.Time `json:"unhealthyUntil,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	LatencyMs      float64    `json:"latencyMs,omitempty"`
+}
+
+type endpointHealth struct {
+	unhealthyUntil time.Time
+	lastErr        error
+	latency        time.Duration
+}
+
+// endpoints remembers the health of SSH host endpoints for the lifetime of
+// the plugin process, so every datasource using a bastion benefits from
+// failures seen by the others.
+var endpoints = struct {
+	sync.Mutex
+	health map[string]*endpointHealth
+}{health: make(map[string]*endpointHealth)}
+
+func endpointHealthLocked(addr string) *endpointHealth {
+	h, ok := endpoints.health[addr]
+	if !ok {
+		h = &endpointHealth{}
+		endpoints.health[addr] = h
+	}
+	return h
+}
+
+func recordEndpointFailure(addr string, err error, cooldown time.Duration) {
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	h := endpointHealthLocked(addr)
+	h.unhealthyUntil = time.Now().Add(cooldown)
+	h.lastErr = err
+}
+
+func recordEndpointSuccess(addr string) {
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	h := endpointHealthLocked(addr)
+	h.unhealthyUntil = time.Time{}
+	h.lastErr = nil
+}
+
+func recordEndpointLatency(addr string, latency time.Duration) {
+	if latency <= 0 {
+		return
+	}
+
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	h := endpointHealthLocked(addr)
+	if h.latency == 0 {
+		h.latency = latency
+		return
+	}
+	h.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(h.latency))
+}
+
+// endpointList returns the SSH host followed by its alternative endpoints,
+// without duplicates.
+func (c TunnelConfig) endpointList() []Endpoint {
+	all := []Endpoint{{Host: c.SSHHost, Port: c.SSHPort}}
+	seen := map[string]bool{all[0].addr(): true}
+	for _, e := range c.Endpoints {
+		if e.Port == 0 {
+			e.Port = c.SSHPort
+		}
+		if !seen[e.addr()] {
+			seen[e.addr()] = true
+			all = append(all, e)
+		}
+	}
+	return all
+}
+
+// candidates returns the SSH host endpoints in the order they should be
+// tried. Endpoints in their cooldown period go last, so they are only used
+// when every other endpoint failed as well.
+func (c TunnelConfig) candidates() []Endpoint {
+	all := c.endpointList()
+
+	switch c.Strategy {
+	case StrategyRandom:
+		rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	case StrategyLatency:
+		endpoints.Lock()
+		latency := make(map[string]time.Duration, len(all))
+		for _, e := range all {
+			if h, ok := endpoints.health[e.addr()]; ok {
+				latency[e.addr()] = h.latency
+			}
+		}
+		endpoints.Unlock()
+		// Endpoints without a measurement sort first so they get probed.
+		sort.SliceStable(all, func(i, j int) bool {
+			return latency[all[i].addr()] < latency[all[j].addr()]
+		})
+	}
+
+	now := time.Now()
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	healthy := make([]Endpoint, 0, len(all))
+	var cooling []Endpoint
+	for _, e := range all {
+		if h, ok := endpoints.health[e.addr()]; ok && now.Before(h.unhealthyUntil) {
+			cooling = append(cooling, e)
+			continue
+		}
+		healthy = append(healthy, e)
+	}
+	return append(healthy, cooling...)
+}
+
+// withEndpoint returns a copy of the configuration connecting to e.
+func (c TunnelConfig) withEndpoint(e Endpoint) TunnelConfig {
+	c.SSHHost = e.Host
+	c.SSHPort = e.Port
+	return c
+}
+
+// acquireEndpoint leases a connection to the first SSH host endpoint that can
+// be dialed and authenticated, marking the ones that fail as unhealthy. When
+// ctx is done it gives up without holding that against the endpoint.
+func acquireEndpoint(ctx context.Context, config TunnelConfig, timeout time.Duration) (*Lease, Endpoint, error) {
+	cooldown := config.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultEndpointCooldown
+	}
+
+	var errs []error
+	for _, e := range config.candidates() {
+		lease, err := DefaultPool.Acquire(ctx, config.withEndpoint(e), timeout)
+		if err == nil {
+			recordEndpointSuccess(e.addr())
+			recordEndpointLatency(e.addr(), lease.dialDuration)
+			return lease, e, nil
+		}
+		if ctx.Err() != nil {
+			return nil, Endpoint{}, err
+		}
+		dialFailures.WithLabelValues(config.DatasourceUID, dialFailureReason(err)).Inc()
+
+		// A failing jump host or proxy is not the SSH host's fault.
+		var hopErr *HopError
+		if errors.As(err, &hopErr) && hopErr.Index < len(config.JumpHosts) {
+			return nil, Endpoint{}, err
+		}
+		var proxyErr *ProxyError
+		if errors.As(err, &proxyErr) {
+			return nil, Endpoint{}, err
+		}
+
+		recordEndpointFailure(e.addr(), err, cooldown)
+		if len(config.Endpoints) > 0 {
+			log.DefaultLogger.Warn("SSH host failed, trying next", "host", e.addr(), "error", err)
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 1 {
+		return nil, Endpoint{}, errs[0]
+	}
+	return nil, Endpoint{}, fmt.Errorf("all SSH hosts failed: %w", errors.Join(errs...))
+}
+
+// EndpointStates reports the health of every SSH host endpoint of config.
+// connected is the address currently in use, if any.
+func EndpointStates(config TunnelConfig, connected string) []EndpointState {
+	now := time.Now()
+	all := config.endpointList()
+
+	endpoints.Lock()
+	defer endpoints.Unlock()
+
+	states := make([]EndpointState, 0, len(all))
+	for _, e := range all {
+		state := EndpointState{
+			Address:   e.addr(),
+			Healthy:   true,
+			Connected: e.addr() == connected,
+		}
+		if h, ok := endpoints.health[e.addr()]; ok {
+			if now.Before(h.unhealthyUntil) {
+				until := h.unhealthyUntil
+				state.Healthy = false
+				state.UnhealthyUntil = &until
+			}
+			if h.lastErr != nil {
+				state.LastError = h.lastErr.Error()
+			}
+			state.LatencyMs = float64(h.latency) / float64(time.Millisecond)
+		}
+		states = append(states, state)
+	}
+	return states
+}
@@ -0,0 +1,170 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key policies supported by HopConfig.HostKeyPolicy.
+const (
+	HostKeyPolicyTOFU        = "tofu"
+	HostKeyPolicyKnownHosts  = "known_hosts"
+	HostKeyPolicyFingerprint = "fingerprint"
+	HostKeyPolicyInsecure    = "insecure"
+)
+
+// HostKeyMismatchError is returned when the key presented by the SSH server
+// does not match any of the expected keys.
+type HostKeyMismatchError struct {
+	Host      string
+	Presented string
+	Expected  []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("host key verification failed for %s: presented %s, host is not in known_hosts", e.Host, e.Presented)
+	}
+	return fmt.Sprintf("host key verification failed for %s: presented %s, expected %s", e.Host, e.Presented, strings.Join(e.Expected, " or "))
+}
+
+// tofuStore remembers the first host key seen for each address for the
+// lifetime of the plugin process.
+var tofuStore = struct {
+	sync.Mutex
+	keys map[string]ssh.PublicKey
+}{keys: make(map[string]ssh.PublicKey)}
+
+func buildHostKeyCallback(config HopConfig) (ssh.HostKeyCallback, error) {
+	switch config.HostKeyPolicy {
+	case HostKeyPolicyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	case HostKeyPolicyKnownHosts:
+		return knownHostsCallback(config.KnownHosts)
+	case HostKeyPolicyFingerprint:
+		return fingerprintCallback(config.HostKeyFingerprint)
+	case HostKeyPolicyTOFU, "":
+		return tofuCallback, nil
+	default:
+		return nil, fmt.Errorf("unknown host key policy %q", config.HostKeyPolicy)
+	}
+}
+
+func knownHostsCallback(knownHosts string) (ssh.HostKeyCallback, error) {
+	if strings.TrimSpace(knownHosts) == "" {
+		return nil, fmt.Errorf("host key policy is known_hosts but no known_hosts entries are configured")
+	}
+
+	// knownhosts only reads from files, so spill the blob to a temporary file
+	// that is removed as soon as it has been parsed.
+	f, err := os.CreateTemp("", "ssh-prometheus-known-hosts-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create known_hosts file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(knownHosts); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write known_hosts file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write known_hosts file: %w", err)
+	}
+
+	callback, err := knownhosts.New(f.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			expected := make([]string, 0, len(keyErr.Want))
+			for _, want := range keyErr.Want {
+				expected = append(expected, ssh.FingerprintSHA256(want.Key))
+			}
+			return &HostKeyMismatchError{
+				Host:      hostname,
+				Presented: ssh.FingerprintSHA256(key),
+				Expected:  expected,
+			}
+		}
+
+		var revokedErr *knownhosts.RevokedError
+		if errors.As(err, &revokedErr) {
+			return fmt.Errorf("host key %s for %s is marked as revoked", ssh.FingerprintSHA256(key), hostname)
+		}
+
+		return err
+	}, nil
+}
+
+func fingerprintCallback(pinned string) (ssh.HostKeyCallback, error) {
+	var expected []string
+	for _, fp := range strings.Split(pinned, ",") {
+		fp = strings.TrimSpace(fp)
+		if fp == "" {
+			continue
+		}
+		if !strings.HasPrefix(fp, "SHA256:") {
+			fp = "SHA256:" + fp
+		}
+		expected = append(expected, strings.TrimRight(fp, "="))
+	}
+
+	if len(expected) == 0 {
+		return nil, fmt.Errorf("host key policy is fingerprint but no fingerprint is configured")
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := ssh.FingerprintSHA256(key)
+		for _, fp := range expected {
+			if fp == presented {
+				return nil
+			}
+		}
+		return &HostKeyMismatchError{
+			Host:      hostname,
+			Presented: presented,
+			Expected:  expected,
+		}
+	}, nil
+}
+
+func tofuCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	addr := knownhosts.Normalize(hostname)
+
+	tofuStore.Lock()
+	defer tofuStore.Unlock()
+
+	known, ok := tofuStore.keys[addr]
+	if !ok {
+		tofuStore.keys[addr] = key
+		log.DefaultLogger.Info("Trusting SSH host key on first use", "host", addr, "fingerprint", ssh.FingerprintSHA256(key))
+		return nil
+	}
+
+	if bytes.Equal(known.Marshal(), key.Marshal()) {
+		return nil
+	}
+
+	return &HostKeyMismatchError{
+		Host:      addr,
+		Presented: ssh.FingerprintSHA256(key),
+		Expected:  []string{ssh.FingerprintSHA256(known)},
+	}
+}
@@ -0,0 +1,58 @@
+package ssh
+
+import (
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// touch records traffic through the tunnel.
+func (t *Tunnel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+// LastActivity returns when data was last transferred through the tunnel, or
+// when it was created if it has not been used yet.
+func (t *Tunnel) LastActivity() time.Time {
+	return time.Unix(0, t.lastActivity.Load())
+}
+
+// IdleClosed reports whether the tunnel closed itself because it was unused
+// for longer than the configured idle timeout.
+func (t *Tunnel) IdleClosed() bool {
+	return t.idleClosed.Load()
+}
+
+// idleTimer returns a timer for the idle timeout, or nil when the tunnel
+// never closes for being idle.
+func (t *Tunnel) idleTimer() *time.Timer {
+	if t.config.IdleTimeout <= 0 {
+		return nil
+	}
+	return time.NewTimer(t.config.IdleTimeout)
+}
+
+// checkIdle closes the tunnel once it has been idle for the configured
+// timeout and reports whether it did. Otherwise timer is re-armed for the
+// remaining time. A tunnel with open channels is never idle, even if they
+// wait for a slow response without transferring anything, and is checked
+// again after a quarter of the timeout so that it closes soon after its
+// last channel.
+func (t *Tunnel) checkIdle(timer *time.Timer) bool {
+	if t.channels.len() > 0 {
+		timer.Reset(t.config.IdleTimeout / 4)
+		return false
+	}
+
+	idle := time.Since(t.LastActivity())
+	if idle < t.config.IdleTimeout {
+		timer.Reset(t.config.IdleTimeout - idle)
+		return false
+	}
+
+	log.DefaultLogger.Info("Closing idle SSH tunnel", "host", t.Endpoint(), "idle", idle.Round(time.Second))
+	t.idleClosed.Store(true)
+	// A channel opened since the check above gets the usual grace period.
+	t.close(t.config.DrainTimeout)
+	return true
+}
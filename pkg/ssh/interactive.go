@@ -0,0 +1,112 @@
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Default prompt patterns used to recognise keyboard-interactive challenges.
+const (
+	DefaultPasswordPrompt = `(?i)password`
+	DefaultOTPPrompt      = `(?i)(verification|one[- ]time|otp|token|code)`
+)
+
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+)
+
+// PromptRules are regular expressions matched against keyboard-interactive
+// questions to decide how to answer them. The OTP rule is checked first.
+type PromptRules struct {
+	Password string
+	OTP      string
+}
+
+// keyboardInteractive answers keyboard-interactive challenges with the
+// configured password and a TOTP code generated from the OTP secret.
+func keyboardInteractive(config HopConfig) (ssh.AuthMethod, error) {
+	passwordPattern := config.PromptRules.Password
+	if passwordPattern == "" {
+		passwordPattern = DefaultPasswordPrompt
+	}
+	passwordPrompt, err := regexp.Compile(passwordPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid password prompt pattern: %w", err)
+	}
+
+	otpPattern := config.PromptRules.OTP
+	if otpPattern == "" {
+		otpPattern = DefaultOTPPrompt
+	}
+	otpPrompt, err := regexp.Compile(otpPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTP prompt pattern: %w", err)
+	}
+
+	var secret []byte
+	if config.OTPSecret != "" {
+		secret, err = decodeOTPSecret(config.OTPSecret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			switch {
+			case otpPrompt.MatchString(q):
+				if secret == nil {
+					return nil, fmt.Errorf("server asked for a one-time code (%q) but no OTP secret is configured", q)
+				}
+				answers[i] = totp(secret, time.Now())
+			case passwordPrompt.MatchString(q):
+				if config.SSHPassword == "" {
+					return nil, fmt.Errorf("server asked for a password (%q) but none is configured", q)
+				}
+				answers[i] = config.SSHPassword
+			default:
+				return nil, fmt.Errorf("unrecognized keyboard-interactive prompt %q", q)
+			}
+		}
+		return answers, nil
+	}), nil
+}
+
+func decodeOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(secret), " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base32 OTP secret: %w", err)
+	}
+	return key, nil
+}
+
+// totp computes an RFC 6238 time-based one-time password using HMAC-SHA1,
+// 30 second steps and 6 digits, the defaults of common authenticator apps.
+func totp(key []byte, now time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(now.Unix()/int64(totpPeriod/time.Second)))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
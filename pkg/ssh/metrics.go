@@ -0,0 +1,195 @@
+package ssh
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/crypto/ssh"
+)
+
+// Tunnel metrics are labeled with TunnelConfig.DatasourceUID.
+var (
+	activeChannels = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sshprometheus",
+		Subsystem: "tunnel",
+		Name:      "active_channels",
+		Help:      "Number of open SSH channels to the remote target.",
+	}, []string{"datasource_uid"})
+
+	dialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sshprometheus",
+		Subsystem: "tunnel",
+		Name:      "dial_failures_total",
+		Help:      "Failed SSH connection and channel attempts by reason.",
+	}, []string{"datasource_uid", "reason"})
+
+	transferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sshprometheus",
+		Subsystem: "tunnel",
+		Name:      "bytes_total",
+		Help:      "Bytes transferred through the tunnel, in from and out to the remote target.",
+	}, []string{"datasource_uid", "direction"})
+
+	reconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sshprometheus",
+		Subsystem: "tunnel",
+		Name:      "reconnects_total",
+		Help:      "Number of times the tunnel was re-established after losing its connection.",
+	}, []string{"datasource_uid"})
+
+	keepaliveRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sshprometheus",
+		Subsystem: "tunnel",
+		Name:      "keepalive_rtt_seconds",
+		Help:      "Round trip time of SSH keepalive requests.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"datasource_uid"})
+
+	uptimeDesc = prometheus.NewDesc(
+		"sshprometheus_tunnel_uptime_seconds",
+		"Seconds since the tunnel's current SSH connection was established, 0 while reconnecting.",
+		[]string{"datasource_uid"}, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(liveTunnels)
+}
+
+// DeleteMetrics removes the tunnel metrics of a datasource, so that disposed
+// datasources do not leave series behind.
+func DeleteMetrics(datasourceUID string) {
+	labels := prometheus.Labels{"datasource_uid": datasourceUID}
+	activeChannels.DeletePartialMatch(labels)
+	dialFailures.DeletePartialMatch(labels)
+	transferredBytes.DeletePartialMatch(labels)
+	reconnects.DeletePartialMatch(labels)
+	keepaliveRTT.DeletePartialMatch(labels)
+}
+
+// liveTunnels tracks open tunnels to report their uptime at scrape time.
+var liveTunnels = &tunnelCollector{tunnels: make(map[*Tunnel]struct{})}
+
+type tunnelCollector struct {
+	mu      sync.Mutex
+	tunnels map[*Tunnel]struct{}
+}
+
+func (c *tunnelCollector) add(t *Tunnel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tunnels[t] = struct{}{}
+}
+
+func (c *tunnelCollector) remove(t *Tunnel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tunnels, t)
+}
+
+func (c *tunnelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- uptimeDesc
+}
+
+func (c *tunnelCollector) Collect(ch chan<- prometheus.Metric) {
+	// Tunnel locks are taken without holding c.mu, so closing tunnels and
+	// scrapes cannot block each other.
+	c.mu.Lock()
+	tunnels := make([]*Tunnel, 0, len(c.tunnels))
+	for t := range c.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	c.mu.Unlock()
+
+	for _, t := range tunnels {
+		ch <- prometheus.MustNewConstMetric(uptimeDesc, prometheus.GaugeValue, t.uptime().Seconds(), t.config.DatasourceUID)
+	}
+}
+
+// uptime returns how long the current SSH connection has been up.
+func (t *Tunnel) uptime() time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if !t.connected {
+		return 0
+	}
+	return time.Since(t.connectedAt)
+}
+
+// dialFailureReason classifies connection errors for the dial failure metric.
+func dialFailureReason(err error) string {
+	var (
+		mismatch *HostKeyMismatchError
+		proxyErr *ProxyError
+		chanErr  *ssh.OpenChannelError
+	)
+	switch {
+	case errors.Is(err, ErrTunnelReconnecting):
+		return "reconnecting"
+	case errors.As(err, &mismatch):
+		return "host_key"
+	case errors.As(err, &proxyErr):
+		return "proxy"
+	case errors.As(err, &chanErr):
+		return "channel"
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return "auth"
+	default:
+		return "connect"
+	}
+}
+
+// meteredConn counts the bytes of a channel to the remote target and keeps
+// the active channel gauge up to date. touch is called whenever data is
+// transferred.
+type meteredConn struct {
+	net.Conn
+	in, out prometheus.Counter
+	active  prometheus.Gauge
+	touch   func()
+	closed  atomic.Bool
+}
+
+func newMeteredConn(conn net.Conn, uid string, touch func()) *meteredConn {
+	active := activeChannels.WithLabelValues(uid)
+	active.Inc()
+	return &meteredConn{
+		Conn:   conn,
+		in:     transferredBytes.WithLabelValues(uid, "in"),
+		out:    transferredBytes.WithLabelValues(uid, "out"),
+		active: active,
+		touch:  touch,
+	}
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.in.Add(float64(n))
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.out.Add(float64(n))
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.active.Dec()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,292 @@
+package ssh
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultPoolLinger is how long an unused pooled connection is kept open, so
+// that a datasource that is re-saved can pick it up again without
+// re-authenticating.
+const DefaultPoolLinger = time.Minute
+
+// DefaultPool is the process wide connection pool shared by all tunnels.
+var DefaultPool = NewPool(DefaultPoolLinger)
+
+// Pool shares SSH connections between tunnels. Connections are keyed by the
+// full hop chain, i.e. host, port, user and a fingerprint of the credentials
+// of every hop, and are reference counted.
+type Pool struct {
+	mu     sync.Mutex
+	conns  map[string]*pooledConn
+	linger time.Duration
+}
+
+type pooledConn struct {
+	key      string
+	chain    []*ssh.Client
+	hosts    []string
+	hops     []HopInfo
+	refs     int
+	created  time.Time
+	released time.Time
+	timer    *time.Timer
+	closed   bool
+}
+
+// Lease is a reference to a pooled connection. It must be released exactly
+// once.
+type Lease struct {
+	pool *Pool
+	conn *pooledConn
+	once sync.Once
+
+	// dialDuration is how long connecting took, zero for reused connections.
+	dialDuration time.Duration
+}
+
+// PoolStats describes a pooled connection.
+type PoolStats struct {
+	Key     string    `json:"key"`
+	Hosts   []string  `json:"hosts"`
+	Refs    int       `json:"refs"`
+	Created time.Time `json:"created"`
+	// IdleSince is set when no tunnel uses the connection.
+	IdleSince *time.Time `json:"idleSince,omitempty"`
+}
+
+// NewPool creates a pool that keeps unused connections open for linger.
+func NewPool(linger time.Duration) *Pool {
+	return &Pool{
+		conns:  make(map[string]*pooledConn),
+		linger: linger,
+	}
+}
+
+// poolKeySecret keys the credential fingerprints, so that pool statistics
+// cannot be used to guess credentials.
+var poolKeySecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// poolKey identifies a hop chain by its addresses, users and a fingerprint of
+// everything else in the hop and proxy configurations, including the
+// credentials. Chains that reach the first hop through different proxies do
+// not share a connection.
+func poolKey(config TunnelConfig) (string, []string, error) {
+	hops := config.Hops()
+
+	raw, err := json.Marshal(struct {
+		Hops  []HopConfig
+		Proxy ProxyConfig
+	}{hops, config.Proxy})
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fingerprint SSH configuration: %w", err)
+	}
+	mac := hmac.New(sha256.New, poolKeySecret)
+	mac.Write(raw)
+	sum := mac.Sum(nil)
+
+	hosts := make([]string, 0, len(hops))
+	for _, hop := range hops {
+		hosts = append(hosts, fmt.Sprintf("%s@%s", hop.SSHUsername, hop.addr()))
+	}
+
+	key := strings.Join(hosts, ",")
+	if config.Proxy.Type != "" {
+		key = fmt.Sprintf("%s://%s,%s", config.Proxy.Type, config.Proxy.Address, key)
+	}
+	return key + "#" + hex.EncodeToString(sum[:8]), hosts, nil
+}
+
+// Acquire returns a lease on a connection for config, dialing a new one if
+// the pool has none. Dialing is aborted when ctx is done.
+func (p *Pool) Acquire(ctx context.Context, config TunnelConfig, timeout time.Duration) (*Lease, error) {
+	key, hosts, err := poolKey(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if lease := p.lease(key); lease != nil {
+		return lease, nil
+	}
+
+	start := time.Now()
+	info := &ConnectionInfo{}
+	chain, err := dialChain(ctx, config, timeout, info)
+	if err != nil {
+		return nil, err
+	}
+	dialDuration := time.Since(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Another tunnel may have connected while we were dialing.
+	if conn, ok := p.conns[key]; ok {
+		closeChain(chain)
+		return p.leaseLocked(conn), nil
+	}
+
+	conn := &pooledConn{
+		key:     key,
+		chain:   chain,
+		hosts:   hosts,
+		hops:    info.Hops,
+		created: time.Now(),
+	}
+	p.conns[key] = conn
+	log.DefaultLogger.Debug("Added SSH connection to pool", "hosts", hosts)
+
+	lease := p.leaseLocked(conn)
+	lease.dialDuration = dialDuration
+	return lease, nil
+}
+
+func (p *Pool) lease(key string) *Lease {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn, ok := p.conns[key]
+	if !ok {
+		return nil
+	}
+	return p.leaseLocked(conn)
+}
+
+func (p *Pool) leaseLocked(conn *pooledConn) *Lease {
+	conn.refs++
+	if conn.timer != nil {
+		conn.timer.Stop()
+		conn.timer = nil
+	}
+	return &Lease{pool: p, conn: conn}
+}
+
+// Client returns the SSH client connected to the last hop of the chain.
+func (l *Lease) Client() *ssh.Client {
+	return l.conn.chain[len(l.conn.chain)-1]
+}
+
+// Hops describes the hops of the connection as they were dialed.
+func (l *Lease) Hops() []HopInfo {
+	return l.conn.hops
+}
+
+// Release drops the reference. The connection is closed once it has been
+// unused for the pool's linger period.
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		l.pool.release(l.conn)
+	})
+}
+
+// Invalidate removes a broken connection from the pool and closes it, so
+// the next Acquire dials a fresh one. The lease is released as well.
+func (l *Lease) Invalidate() {
+	l.pool.invalidate(l.conn)
+	l.Release()
+}
+
+func (p *Pool) release(conn *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	conn.refs--
+	if conn.refs > 0 || conn.closed {
+		return
+	}
+
+	conn.released = time.Now()
+	if p.linger <= 0 {
+		p.closeLocked(conn)
+		return
+	}
+	conn.timer = time.AfterFunc(p.linger, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if conn.refs == 0 {
+			p.closeLocked(conn)
+		}
+	})
+}
+
+func (p *Pool) invalidate(conn *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked(conn)
+}
+
+func (p *Pool) closeLocked(conn *pooledConn) {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	if conn.timer != nil {
+		conn.timer.Stop()
+		conn.timer = nil
+	}
+	if p.conns[conn.key] == conn {
+		delete(p.conns, conn.key)
+	}
+	closeChain(conn.chain)
+	log.DefaultLogger.Debug("Closed pooled SSH connection", "hosts", conn.hosts)
+}
+
+// StatsFor returns a snapshot of the pooled connections that config uses or
+// would use, one per SSH host endpoint. Connections of other configurations
+// are left out, as their keys and hosts describe other datasources.
+func (p *Pool) StatsFor(config TunnelConfig) ([]PoolStats, error) {
+	keys := make(map[string]bool)
+	for _, e := range config.endpointList() {
+		key, _, err := poolKey(config.withEndpoint(e))
+		if err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	return p.stats(keys), nil
+}
+
+// stats returns the pooled connections whose key is in keys.
+func (p *Pool) stats(keys map[string]bool) []PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]PoolStats, 0, len(keys))
+	for _, conn := range p.conns {
+		if !keys[conn.key] {
+			continue
+		}
+		s := PoolStats{
+			Key:     conn.key,
+			Hosts:   conn.hosts,
+			Refs:    conn.refs,
+			Created: conn.created,
+		}
+		if conn.refs == 0 {
+			idle := conn.released
+			s.IdleSince = &idle
+		}
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Key < stats[j].Key })
+	return stats
+}
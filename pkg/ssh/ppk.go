@@ -0,0 +1,294 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+const ppkHeader = "PuTTY-User-Key-File-"
+
+func isPPK(key []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(key), []byte(ppkHeader))
+}
+
+// ppkFile is a parsed PuTTY .ppk key file of format version 2 or 3.
+type ppkFile struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	headers    map[string]string
+}
+
+func parsePPKFile(data []byte) (*ppkFile, error) {
+	lines := strings.Split(strings.ReplaceAll(strings.TrimSpace(string(data)), "\r\n", "\n"), "\n")
+	f := &ppkFile{headers: make(map[string]string)}
+
+	for i := 0; i < len(lines); i++ {
+		name, value, ok := strings.Cut(lines[i], ": ")
+		if !ok {
+			return nil, fmt.Errorf("malformed PPK line %d", i+1)
+		}
+		value = strings.TrimSpace(value)
+
+		switch {
+		case strings.HasPrefix(name, ppkHeader):
+			version, err := strconv.Atoi(strings.TrimPrefix(name, ppkHeader))
+			if err != nil || (version != 2 && version != 3) {
+				return nil, fmt.Errorf("unsupported PPK version %q", strings.TrimPrefix(name, ppkHeader))
+			}
+			f.version = version
+			f.algorithm = value
+		case name == "Public-Lines" || name == "Private-Lines":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || i+n >= len(lines) {
+				return nil, fmt.Errorf("invalid %s", name)
+			}
+			blob, err := base64.StdEncoding.DecodeString(strings.Join(lines[i+1:i+1+n], ""))
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s data: %w", name, err)
+			}
+			if name == "Public-Lines" {
+				f.public = blob
+			} else {
+				f.private = blob
+			}
+			i += n
+		case name == "Private-MAC":
+			mac, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Private-MAC: %w", err)
+			}
+			f.mac = mac
+		default:
+			f.headers[name] = value
+		}
+	}
+
+	if f.version == 0 {
+		return nil, errors.New("missing PPK header")
+	}
+	if f.public == nil || f.private == nil || f.mac == nil {
+		return nil, errors.New("incomplete PPK file")
+	}
+	f.encryption = f.headers["Encryption"]
+	f.comment = f.headers["Comment"]
+	if f.encryption != "none" && f.encryption != "aes256-cbc" {
+		return nil, fmt.Errorf("unsupported PPK encryption %q", f.encryption)
+	}
+	return f, nil
+}
+
+// keys derives the AES key and IV and the MAC key from the passphrase.
+func (f *ppkFile) keys(passphrase string) (cipherKey, iv, macKey []byte, err error) {
+	if f.version == 2 {
+		key := make([]byte, 0, 40)
+		for i := uint32(0); i < 2; i++ {
+			h := sha1.New()
+			binary.Write(h, binary.BigEndian, i)
+			h.Write([]byte(passphrase))
+			key = h.Sum(key)
+		}
+		mac := sha1.Sum([]byte("putty-private-key-file-mac-key" + passphrase))
+		return key[:32], make([]byte, aes.BlockSize), mac[:], nil
+	}
+
+	if f.encryption == "none" {
+		return nil, nil, nil, nil
+	}
+
+	memory, err1 := strconv.ParseUint(f.headers["Argon2-Memory"], 10, 32)
+	passes, err2 := strconv.ParseUint(f.headers["Argon2-Passes"], 10, 32)
+	parallelism, err3 := strconv.ParseUint(f.headers["Argon2-Parallelism"], 10, 8)
+	salt, err4 := hex.DecodeString(f.headers["Argon2-Salt"])
+	if err := errors.Join(err1, err2, err3, err4); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid Argon2 parameters: %w", err)
+	}
+
+	var derived []byte
+	switch f.headers["Key-Derivation"] {
+	case "Argon2id":
+		derived = argon2.IDKey([]byte(passphrase), salt, uint32(passes), uint32(memory), uint8(parallelism), 80)
+	case "Argon2i":
+		derived = argon2.Key([]byte(passphrase), salt, uint32(passes), uint32(memory), uint8(parallelism), 80)
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported PPK key derivation %q", f.headers["Key-Derivation"])
+	}
+	return derived[:32], derived[32:48], derived[48:], nil
+}
+
+// decrypt returns the private blob and verifies the file's MAC.
+func (f *ppkFile) decrypt(passphrase string) ([]byte, error) {
+	cipherKey, iv, macKey, err := f.keys(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	private := f.private
+	if f.encryption == "aes256-cbc" {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, errors.New("invalid PPK private key length")
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		private = make([]byte, len(f.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, f.private)
+	}
+
+	var mac hash.Hash
+	if f.version == 2 {
+		mac = hmac.New(sha1.New, macKey)
+	} else {
+		mac = hmac.New(sha256.New, macKey)
+	}
+	for _, field := range [][]byte{[]byte(f.algorithm), []byte(f.encryption), []byte(f.comment), f.public, private} {
+		binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+	if !hmac.Equal(mac.Sum(nil), f.mac) {
+		if f.encryption != "none" {
+			return nil, errors.New("incorrect passphrase or corrupt PPK file")
+		}
+		return nil, errors.New("corrupt PPK file: MAC mismatch")
+	}
+	return private, nil
+}
+
+// parsePPK parses a PuTTY private key. Like ssh.ParsePrivateKey it returns a
+// *ssh.PassphraseMissingError for encrypted keys without passphrase.
+func parsePPK(data []byte, passphrase string) (ssh.Signer, error) {
+	f, err := parsePPKFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := ssh.ParsePublicKey(f.public)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PPK public key: %w", err)
+	}
+	if f.encryption != "none" && passphrase == "" {
+		return nil, &ssh.PassphraseMissingError{PublicKey: pub}
+	}
+
+	private, err := f.decrypt(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ppkPrivateKey(pub, private)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// ppkPrivateKey combines the public key with PuTTY's private blob.
+func ppkPrivateKey(pub ssh.PublicKey, private []byte) (any, error) {
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported PPK key type %s", pub.Type())
+	}
+	r := &wireReader{buf: private}
+
+	switch pk := cryptoPub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		// iqmp follows, Precompute derives it again.
+		d, p, q := r.mpint(), r.mpint(), r.mpint()
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid PPK RSA key: %w", r.err)
+		}
+		key := &rsa.PrivateKey{PublicKey: *pk, D: d, Primes: []*big.Int{p, q}}
+		if err := key.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid PPK RSA key: %w", err)
+		}
+		key.Precompute()
+		return key, nil
+	case *ecdsa.PublicKey:
+		d := r.mpint()
+		if r.err != nil {
+			return nil, fmt.Errorf("invalid PPK ECDSA key: %w", r.err)
+		}
+		x, y := pk.Curve.ScalarBaseMult(d.Bytes())
+		if x.Cmp(pk.X) != 0 || y.Cmp(pk.Y) != 0 {
+			return nil, errors.New("invalid PPK ECDSA key: private key does not match public key")
+		}
+		return &ecdsa.PrivateKey{PublicKey: *pk, D: d}, nil
+	case ed25519.PublicKey:
+		// PuTTY stores the seed as a little-endian integer without the
+		// trailing zero bytes.
+		b := r.string()
+		if r.err != nil || len(b) > ed25519.SeedSize {
+			return nil, errors.New("invalid PPK Ed25519 key")
+		}
+		seed := make([]byte, ed25519.SeedSize)
+		copy(seed, b)
+		key := ed25519.NewKeyFromSeed(seed)
+		if !bytes.Equal(key.Public().(ed25519.PublicKey), pk) {
+			return nil, errors.New("invalid PPK Ed25519 key: private key does not match public key")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported PPK key type %s", pub.Type())
+	}
+}
+
+// wireReader reads SSH wire format strings and mpints, remembering the first
+// error.
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) string() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < 4 {
+		r.err = errors.New("truncated data")
+		return nil
+	}
+	n := binary.BigEndian.Uint32(r.buf)
+	if uint64(n) > uint64(len(r.buf)-4) {
+		r.err = errors.New("truncated data")
+		return nil
+	}
+	s := r.buf[4 : 4+n]
+	r.buf = r.buf[4+n:]
+	return s
+}
+
+func (r *wireReader) mpint() *big.Int {
+	b := r.string()
+	if r.err != nil {
+		return nil
+	}
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		r.err = errors.New("negative mpint")
+		return nil
+	}
+	return new(big.Int).SetBytes(b)
+}
@@ -0,0 +1,165 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The fixtures in testdata/ppk hold one RSA, ECDSA (nistp256) and Ed25519
+// key each, as PPK versions 2 and 3, unencrypted and encrypted with
+// ppkPassphrase, next to the public key in OpenSSH format. generate.sh
+// creates them with PuTTYgen. The files committed so far were written by an
+// encoder following the PuTTY file format documentation, as PuTTYgen was not
+// at hand; run the script to replace them with PuTTYgen output.
+const ppkPassphrase = "correct horse"
+
+var ppkKeyTypes = map[string]struct {
+	keyType string
+	bits    int
+}{
+	"rsa":     {ssh.KeyAlgoRSA, 2048},
+	"ecdsa":   {ssh.KeyAlgoECDSA256, 256},
+	"ed25519": {ssh.KeyAlgoED25519, 256},
+}
+
+type ppkFixture struct {
+	name      string
+	key       string
+	publicKey ssh.PublicKey
+	encrypted bool
+}
+
+func ppkFixtures(t *testing.T) []ppkFixture {
+	t.Helper()
+	var fixtures []ppkFixture
+	for name := range ppkKeyTypes {
+		pubData, err := os.ReadFile("testdata/ppk/" + name + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, version := range []int{2, 3} {
+			for _, encrypted := range []bool{false, true} {
+				file := fmt.Sprintf("%s-v%d", name, version)
+				if encrypted {
+					file += "-encrypted"
+				}
+				key, err := os.ReadFile("testdata/ppk/" + file + ".ppk")
+				if err != nil {
+					t.Fatal(err)
+				}
+				fixtures = append(fixtures, ppkFixture{name: file, key: string(key), publicKey: pub, encrypted: encrypted})
+			}
+		}
+	}
+	return fixtures
+}
+
+func TestParsePPK(t *testing.T) {
+	for _, f := range ppkFixtures(t) {
+		t.Run(f.name, func(t *testing.T) {
+			passphrase := ""
+			if f.encrypted {
+				passphrase = ppkPassphrase
+			}
+			signer, err := parsePrivateKey(f.key, passphrase)
+			if err != nil {
+				t.Fatalf("parsePrivateKey: %v", err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), f.publicKey.Marshal()) {
+				t.Fatalf("got public key %s, want %s", ssh.FingerprintSHA256(signer.PublicKey()), ssh.FingerprintSHA256(f.publicKey))
+			}
+
+			// The private key has to match the public key, not just parse.
+			msg := []byte("ssh-prometheus-datasource")
+			sig, err := signer.Sign(rand.Reader, msg)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			if err := f.publicKey.Verify(msg, sig); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePPKCRLF(t *testing.T) {
+	for _, f := range ppkFixtures(t) {
+		if f.encrypted {
+			continue
+		}
+		if _, err := parsePrivateKey(strings.ReplaceAll(f.key, "\n", "\r\n"), ""); err != nil {
+			t.Errorf("%s: %v", f.name, err)
+		}
+	}
+}
+
+func TestParsePPKWrongPassphrase(t *testing.T) {
+	for _, f := range ppkFixtures(t) {
+		if !f.encrypted {
+			continue
+		}
+		_, err := parsePrivateKey(f.key, "wrong horse")
+		if err == nil || !strings.Contains(err.Error(), "incorrect passphrase") {
+			t.Errorf("%s: got %v, want the MAC check to fail", f.name, err)
+		}
+	}
+}
+
+func TestParsePPKMissingPassphrase(t *testing.T) {
+	for _, f := range ppkFixtures(t) {
+		if !f.encrypted {
+			continue
+		}
+		_, err := parsePrivateKey(f.key, "")
+		var missing *ssh.PassphraseMissingError
+		if !errors.As(err, &missing) {
+			t.Errorf("%s: got %v, want *ssh.PassphraseMissingError", f.name, err)
+			continue
+		}
+		if !bytes.Equal(missing.PublicKey.Marshal(), f.publicKey.Marshal()) {
+			t.Errorf("%s: PassphraseMissingError carries the wrong public key", f.name)
+		}
+	}
+}
+
+func TestParsePPKTampered(t *testing.T) {
+	for _, f := range ppkFixtures(t) {
+		key := strings.Replace(f.key, "Comment: ", "Comment: x", 1)
+		passphrase := ""
+		want := "MAC mismatch"
+		if f.encrypted {
+			passphrase = ppkPassphrase
+			want = "incorrect passphrase or corrupt PPK file"
+		}
+		_, err := parsePrivateKey(key, passphrase)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", f.name, err, want)
+		}
+	}
+}
+
+func TestInspectPPK(t *testing.T) {
+	for _, f := range ppkFixtures(t) {
+		info, err := InspectPrivateKey(f.key, "")
+		if err != nil {
+			t.Errorf("%s: %v", f.name, err)
+			continue
+		}
+		want := ppkKeyTypes[strings.SplitN(f.name, "-", 2)[0]]
+		if info.Format != KeyFormatPPK || info.Type != want.keyType || info.Bits != want.bits ||
+			info.Fingerprint != ssh.FingerprintSHA256(f.publicKey) || info.NeedsPassphrase != f.encrypted {
+			t.Errorf("%s: got %+v", f.name, info)
+		}
+	}
+}
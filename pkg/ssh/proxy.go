@@ -0,0 +1,134 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Proxy types supported by ProxyConfig.Type.
+const (
+	ProxyTypeSOCKS5 = "socks5"
+	ProxyTypeHTTP   = "http"
+)
+
+// ProxyConfig describes a SOCKS5 or HTTP CONNECT proxy the first SSH hop is
+// dialed through.
+type ProxyConfig struct {
+	Type     string
+	Address  string
+	Username string
+	Password string
+}
+
+// ProxyError reports a failure while connecting through the proxy, before
+// any SSH traffic was exchanged.
+type ProxyError struct {
+	Proxy string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s: %v", e.Proxy, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// dialProxy opens a TCP connection to addr through the configured proxy.
+func dialProxy(ctx context.Context, config ProxyConfig, addr string) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch config.Type {
+	case ProxyTypeSOCKS5:
+		conn, err = dialSOCKS5(ctx, config, addr)
+	case ProxyTypeHTTP:
+		conn, err = dialHTTPConnect(ctx, config, addr)
+	default:
+		err = fmt.Errorf("unknown proxy type %q", config.Type)
+	}
+	if err != nil {
+		return nil, &ProxyError{Proxy: fmt.Sprintf("%s://%s", config.Type, config.Address), Err: err}
+	}
+	return conn, nil
+}
+
+func dialSOCKS5(ctx context.Context, config ProxyConfig, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if config.Username != "" || config.Password != "" {
+		auth = &proxy.Auth{User: config.Username, Password: config.Password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", config.Address, auth, &net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
+
+func dialHTTPConnect(ctx context.Context, config ProxyConfig, addr string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if config.Username != "" || config.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(config.Username + ":" + config.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT %s failed: %s", addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// The SSH server speaks first, so its banner may already be buffered.
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultCertTTL is the lifetime of minted certificates when CertOptions
+// does not set one.
+const DefaultCertTTL = 5 * time.Minute
+
+// certClockSkew backdates minted certificates so that servers with a slightly
+// slow clock accept them.
+const certClockSkew = time.Minute
+
+// CertOptions configures the user certificates minted by a
+// CertificateAuthority.
+type CertOptions struct {
+	TTL        time.Duration
+	Principals []string
+
+	// CriticalOptions are enforced by the server, e.g. "source-address" or
+	// "force-command".
+	CriticalOptions map[string]string
+
+	// Extensions grant optional features such as "permit-port-forwarding".
+	// When nil, only port forwarding is permitted.
+	Extensions []string
+}
+
+// CertificateAuthority mints short-lived user certificates for freshly
+// generated key pairs, so no long-lived credential is sent to the server.
+type CertificateAuthority struct {
+	signer ssh.Signer
+}
+
+// NewCertificateAuthority loads the CA private key used to sign certificates.
+func NewCertificateAuthority(key, passphrase string) (*CertificateAuthority, error) {
+	signer, err := parsePrivateKey(key, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA private key: %w", err)
+	}
+	return &CertificateAuthority{signer: signer}, nil
+}
+
+// Mint generates an ephemeral ed25519 key pair and returns a signer for it
+// carrying a certificate issued by the CA.
+func (ca *CertificateAuthority) Mint(keyID string, opts CertOptions, now time.Time) (ssh.Signer, *ssh.Certificate, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create ephemeral signer: %w", err)
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate certificate serial: %w", err)
+	}
+
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = DefaultCertTTL
+	}
+
+	extensions := opts.Extensions
+	if extensions == nil {
+		extensions = []string{"permit-port-forwarding"}
+	}
+	permissions := ssh.Permissions{
+		CriticalOptions: make(map[string]string, len(opts.CriticalOptions)),
+		Extensions:      make(map[string]string, len(extensions)),
+	}
+	for k, v := range opts.CriticalOptions {
+		permissions.CriticalOptions[k] = v
+	}
+	for _, ext := range extensions {
+		permissions.Extensions[ext] = ""
+	}
+
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: opts.Principals,
+		ValidAfter:      uint64(now.Add(-certClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(ttl).Unix()),
+		Permissions:     permissions,
+	}
+
+	if err := cert.SignCert(rand.Reader, ca.signer); err != nil {
+		return nil, nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate signer: %w", err)
+	}
+
+	return certSigner, cert, nil
+}
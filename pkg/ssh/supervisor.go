@@ -0,0 +1,217 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults for the keepalive supervisor.
+const (
+	DefaultKeepaliveInterval  = 30 * time.Second
+	DefaultKeepaliveMaxMisses = 3
+
+	reconnectInitialBackoff = time.Second
+	reconnectMaxBackoff     = time.Minute
+	reconnectDialTimeout    = 30 * time.Second
+)
+
+// ErrTunnelReconnecting is returned while the supervisor is re-establishing
+// a lost SSH connection.
+var ErrTunnelReconnecting = errors.New("SSH tunnel reconnecting")
+
+// supervise sends keepalives on the configured interval and reconnects the
+// tunnel in the background once the connection is lost, either because the
+// SSH client terminated or because too many keepalives went unanswered. It
+// also closes the tunnel once it has been idle for the idle timeout.
+func (t *Tunnel) supervise() {
+	interval := t.config.KeepaliveInterval
+	if interval <= 0 {
+		interval = DefaultKeepaliveInterval
+	}
+	maxMisses := t.config.KeepaliveMaxMisses
+	if maxMisses <= 0 {
+		maxMisses = DefaultKeepaliveMaxMisses
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var idleCheck <-chan time.Time
+	idle := t.idleTimer()
+	if idle != nil {
+		defer idle.Stop()
+		idleCheck = idle.C
+	}
+
+	misses := 0
+	for {
+		client, lost := t.currentClient()
+
+		select {
+		case <-t.done:
+			return
+		case <-idleCheck:
+			if t.checkIdle(idle) {
+				return
+			}
+			continue
+		case <-lost:
+			t.markDown(fmt.Errorf("SSH connection closed"))
+		case <-ticker.C:
+			start := time.Now()
+			err := keepalive(client, interval)
+			if err == nil {
+				rtt := time.Since(start)
+				recordEndpointLatency(t.Endpoint(), rtt)
+				keepaliveRTT.WithLabelValues(t.config.DatasourceUID).Observe(rtt.Seconds())
+				misses = 0
+				continue
+			}
+			misses++
+			log.DefaultLogger.Warn("SSH keepalive failed", "host", t.Endpoint(), "misses", misses, "error", err)
+			if misses < maxMisses {
+				continue
+			}
+			t.markDown(fmt.Errorf("%d keepalives missed: %w", misses, err))
+		}
+
+		misses = 0
+		if !t.reconnect() {
+			return
+		}
+	}
+}
+
+// keepalive sends a keepalive request and waits at most timeout for the
+// reply, so a half-open connection does not block the supervisor.
+func keepalive(client *ssh.Client, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@golang.org", true, nil)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no keepalive reply within %s", timeout)
+	}
+}
+
+// watchClient returns a channel that is closed once client's connection
+// terminates.
+func watchClient(client *ssh.Client) <-chan struct{} {
+	lost := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(lost)
+	}()
+	return lost
+}
+
+func (t *Tunnel) currentClient() (*ssh.Client, <-chan struct{}) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.client, t.lost
+}
+
+// markDown drops the broken connection from the pool, so that other tunnels
+// sharing it reconnect as well.
+func (t *Tunnel) markDown(reason error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.connected {
+		return
+	}
+
+	log.DefaultLogger.Warn("SSH tunnel down, reconnecting", "host", t.endpoint.addr(), "reason", reason)
+	t.connected = false
+	t.lastErr = reason
+	if t.lease != nil {
+		t.lease.Invalidate()
+		t.lease = nil
+	}
+}
+
+// reconnect acquires a new connection with exponential backoff and jitter
+// until it succeeds or the tunnel is closed. It reports whether the tunnel
+// is connected again.
+func (t *Tunnel) reconnect() bool {
+	// Closing the tunnel aborts a dial in progress.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-t.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := reconnectInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		lease, endpoint, err := acquireEndpoint(ctx, t.config, reconnectDialTimeout)
+		if err == nil {
+			return t.swapLease(lease, endpoint, attempt)
+		}
+
+		wait := jitter(backoff)
+		log.DefaultLogger.Warn("SSH tunnel reconnect failed", "host", t.config.addr(), "endpoints", len(t.config.Endpoints)+1, "attempt", attempt, "retryIn", wait, "error", err)
+
+		t.mu.Lock()
+		t.lastErr = err
+		t.mu.Unlock()
+
+		select {
+		case <-t.done:
+			return false
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
+		}
+	}
+}
+
+func (t *Tunnel) swapLease(lease *Lease, endpoint Endpoint, attempts int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.alive {
+		lease.Release()
+		return false
+	}
+
+	t.lease = lease
+	t.endpoint = endpoint
+	t.client = lease.Client()
+	t.lost = watchClient(t.client)
+	t.connected = true
+	t.connectedAt = time.Now()
+	t.lastErr = nil
+	reconnects.WithLabelValues(t.config.DatasourceUID).Inc()
+
+	log.DefaultLogger.Info("SSH tunnel reconnected", "host", endpoint.addr(), "attempts", attempts)
+	return true
+}
+
+// jitter spreads d by ±20% so that tunnels sharing a bastion do not
+// reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(rand.Int63n(2*spread))
+}
@@ -0,0 +1,32 @@
+#!/bin/sh
+# Regenerates the PPK fixtures of ppk_test.go with PuTTYgen 0.75 or later:
+# one RSA, ECDSA and Ed25519 key each, as PPK versions 2 and 3, unencrypted
+# and encrypted with the passphrase below, and the OpenSSH public key.
+set -eu
+cd "$(dirname "$0")"
+
+passphrase=$(mktemp)
+trap 'rm -f "$passphrase"' EXIT
+printf '%s' 'correct horse' >"$passphrase"
+
+# A cheap Argon2 setting keeps the tests fast.
+kdf='kdf=argon2id,memory=8192,passes=2,parallelism=1'
+
+for name in rsa ecdsa ed25519; do
+	case $name in
+	rsa) type='-t rsa -b 2048' ;;
+	ecdsa) type='-t ecdsa -b 256' ;;
+	ed25519) type='-t ed25519' ;;
+	esac
+
+	# shellcheck disable=SC2086
+	puttygen $type -q -C "$name-key" --new-passphrase /dev/null \
+		--ppk-param version=3 -o "$name-v3.ppk"
+	puttygen "$name-v3.ppk" -q --new-passphrase /dev/null \
+		--ppk-param version=2 -o "$name-v2.ppk"
+	puttygen "$name-v3.ppk" -q --new-passphrase "$passphrase" \
+		--ppk-param version=2 -o "$name-v2-encrypted.ppk"
+	puttygen "$name-v3.ppk" -q --new-passphrase "$passphrase" \
+		--ppk-param "version=3,$kdf" -o "$name-v3-encrypted.ppk"
+	puttygen "$name-v3.ppk" -O public-openssh -o "$name.pub"
+done
@@ -1,104 +1,291 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"golang.org/x/crypto/ssh"
 )
 
-type TunnelConfig struct {
-	SSHHost         string
-	SSHPort         int
-	SSHUsername     string
-	AuthMethod      string
-	SSHPassword     string
-	SSHPrivateKey   string
+// HopConfig describes a single SSH server in the connection chain.
+type HopConfig struct {
+	SSHHost          string
+	SSHPort          int
+	SSHUsername      string
+	AuthMethod       string
+	SSHPassword      string
+	SSHPrivateKey    string
 	SSHKeyPassphrase string
-	RemoteHost      string
-	RemotePort      int
+
+	// SSHCertificate is an optional OpenSSH user certificate for the private
+	// key, in the format of an id_ed25519-cert.pub file.
+	SSHCertificate string
+
+	// CAPrivateKey is used by the "ca" auth method to sign a fresh key pair
+	// for every connection, with certificates configured by CertOptions.
+	CAPrivateKey    string
+	CAKeyPassphrase string
+	CertOptions     CertOptions
+
+	// OTPSecret is a base32 TOTP seed. Keyboard-interactive challenges are
+	// answered with SSHPassword or a TOTP code depending on PromptRules. The
+	// "keyboard-interactive" auth method uses only this; with other methods
+	// a configured secret adds keyboard-interactive as a second factor.
+	OTPSecret   string
+	PromptRules PromptRules
+
+	// AgentSocket is the ssh-agent Unix socket used by the "agent" auth
+	// method. It defaults to SSH_AUTH_SOCK.
+	AgentSocket string
+
+	// HostKeyPolicy selects how the server's host key is verified. KnownHosts
+	// holds known_hosts formatted entries and HostKeyFingerprint one or more
+	// comma separated SHA256 fingerprints.
+	HostKeyPolicy      string
+	KnownHosts         string
+	HostKeyFingerprint string
+
+	// Algorithms restricts the key exchange, cipher, MAC and host key
+	// algorithms offered to the server.
+	Algorithms AlgorithmPolicy
 }
 
-type Tunnel struct {
-	config     TunnelConfig
-	client     *ssh.Client
-	listener   net.Listener
-	localAddr  string
-	done       chan struct{}
-	mu         sync.RWMutex
-	alive      bool
+func (h HopConfig) addr() string {
+	return net.JoinHostPort(h.SSHHost, strconv.Itoa(h.SSHPort))
 }
 
-func NewTunnel(config TunnelConfig) (*Tunnel, error) {
-	authMethods, err := buildAuthMethods(config)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build auth methods: %w", err)
-	}
+type TunnelConfig struct {
+	// HopConfig is the SSH server the tunnel forwards from.
+	HopConfig
+
+	// JumpHosts are dialed in order before the SSH server, each one through
+	// the previous hop, the same way OpenSSH ProxyJump works.
+	JumpHosts []HopConfig
+
+	// Proxy, when its Type is set, is used to reach the first hop.
+	Proxy ProxyConfig
+
+	// Endpoints are alternative addresses of the SSH host, chosen according
+	// to Strategy. An endpoint that fails to connect or authenticate is
+	// skipped for Cooldown.
+	Endpoints []Endpoint
+	Strategy  string
+	Cooldown  time.Duration
+
+	RemoteHost string
+	RemotePort int
+
+	// RemoteSocket is a Unix socket path on the SSH server. When set, it is
+	// used instead of RemoteHost and RemotePort and connections are opened
+	// as direct-streamlocal@openssh.com channels.
+	RemoteSocket string
+
+	// Transport selects how connections reach the targets: TransportAuto
+	// (the default), TransportForward or TransportExec. Exec connections run
+	// ExecCommand, DefaultExecCommand if empty, in a session per connection.
+	Transport   string
+	ExecCommand string
+
+	// Targets are further named services reachable over the same SSH
+	// connection with DialTarget, e.g. an Alertmanager next to Prometheus.
+	Targets map[string]Target
+
+	// LocalListener additionally exposes the remote target on a random
+	// 127.0.0.1 port. Any local process can connect to that port, so it is
+	// off by default and callers should use Tunnel.DialContext instead.
+	LocalListener bool
+
+	// KeepaliveInterval is how often the supervisor checks the connection,
+	// and KeepaliveMaxMisses how many unanswered keepalives mark it down.
+	KeepaliveInterval  time.Duration
+	KeepaliveMaxMisses int
+
+	// IdleTimeout, when positive, closes the tunnel after no data has been
+	// transferred through it for that long and no connections are open.
+	// Connections kept open for reuse have to be closed by the caller before.
+	IdleTimeout time.Duration
+
+	// DrainTimeout is how long Close waits for open connections to the
+	// remote target to finish before closing them. Zero closes them at once.
+	DrainTimeout time.Duration
+
+	// DatasourceUID labels the tunnel's metrics.
+	DatasourceUID string
+}
 
-	sshConfig := &ssh.ClientConfig{
-		User:            config.SSHUsername,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         30 * time.Second,
-	}
+// Hops returns every SSH server of the chain in dial order.
+func (c TunnelConfig) Hops() []HopConfig {
+	hops := make([]HopConfig, 0, len(c.JumpHosts)+1)
+	hops = append(hops, c.JumpHosts...)
+	return append(hops, c.HopConfig)
+}
+
+type Tunnel struct {
+	config    TunnelConfig
+	client    *ssh.Client
+	lease     *Lease
+	endpoint  Endpoint
+	listener  net.Listener
+	localAddr string
+	done      chan struct{}
+	mu        sync.RWMutex
+	alive     bool
+
+	// connected is false while the supervisor reconnects, lost is closed when
+	// the current client terminates and lastErr holds the last failure.
+	connected   bool
+	connectedAt time.Time
+	lost        <-chan struct{}
+	lastErr     error
+
+	// lastActivity is the time of the last transfer in Unix nanoseconds.
+	lastActivity atomic.Int64
+	idleClosed   atomic.Bool
+
+	// execFallback is set once the server refused port forwarding.
+	execFallback atomic.Bool
+
+	channels channelSet
+}
 
-	addr := fmt.Sprintf("%s:%d", config.SSHHost, config.SSHPort)
-	client, err := ssh.Dial("tcp", addr, sshConfig)
+// NewTunnel creates a tunnel on a connection from DefaultPool, so tunnels
+// with the same hop chain and credentials share one SSH connection. When
+// the SSH host has alternative endpoints, the first one that connects is
+// used. Connecting is aborted when ctx is done.
+func NewTunnel(ctx context.Context, config TunnelConfig) (*Tunnel, error) {
+	lease, endpoint, err := acquireEndpoint(ctx, config, 30*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to SSH server: %w", err)
 	}
 
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		client.Close()
-		return nil, fmt.Errorf("failed to create local listener: %w", err)
+	t := &Tunnel{
+		config:      config,
+		client:      lease.Client(),
+		lease:       lease,
+		endpoint:    endpoint,
+		done:        make(chan struct{}),
+		alive:       true,
+		connected:   true,
+		connectedAt: time.Now(),
+		lost:        watchClient(lease.Client()),
 	}
 
-	t := &Tunnel{
-		config:    config,
-		client:    client,
-		listener:  listener,
-		localAddr: listener.Addr().String(),
-		done:      make(chan struct{}),
-		alive:     true,
+	if config.LocalListener {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			lease.Release()
+			return nil, fmt.Errorf("failed to create local listener: %w", err)
+		}
+		t.listener = listener
+		t.localAddr = listener.Addr().String()
+		go t.acceptLoop()
 	}
 
-	go t.acceptLoop()
+	t.touch()
+	liveTunnels.add(t)
+	go t.supervise()
 
 	return t, nil
 }
 
-func buildAuthMethods(config TunnelConfig) ([]ssh.AuthMethod, error) {
-	var methods []ssh.AuthMethod
+// hopAuth holds the auth methods of a hop together with the resources they
+// need while the handshake is running.
+type hopAuth struct {
+	methods []ssh.AuthMethod
+	agent   *agentAuth
+}
+
+// Close releases resources that are only needed during the handshake.
+func (a *hopAuth) Close() {
+	if a.agent != nil {
+		a.agent.Close()
+	}
+}
+
+func buildAuthMethods(config HopConfig) (*hopAuth, error) {
+	auth := &hopAuth{}
 
-	if config.AuthMethod == "password" {
+	switch config.AuthMethod {
+	case "password":
 		if config.SSHPassword != "" {
-			methods = append(methods, ssh.Password(config.SSHPassword))
+			auth.methods = append(auth.methods, ssh.Password(config.SSHPassword))
+		}
+	case "ca":
+		if config.CAPrivateKey == "" {
+			return nil, fmt.Errorf("no CA private key configured")
 		}
-	} else {
+		ca, err := NewCertificateAuthority(config.CAPrivateKey, config.CAKeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		opts := config.CertOptions
+		if len(opts.Principals) == 0 {
+			opts.Principals = []string{config.SSHUsername}
+		}
+		keyID := fmt.Sprintf("ssh-prometheus-datasource:%s@%s", config.SSHUsername, config.addr())
+		signer, cert, err := ca.Mint(keyID, opts, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		log.DefaultLogger.Debug("Minted SSH user certificate", "keyId", keyID, "serial", cert.Serial, "principals", cert.ValidPrincipals)
+		auth.methods = append(auth.methods, ssh.PublicKeys(signer))
+	case "agent":
+		agentAuth, err := newAgentAuth(config.AgentSocket)
+		if err != nil {
+			return nil, err
+		}
+		auth.agent = agentAuth
+		auth.methods = append(auth.methods, agentAuth.method())
+	case "keyboard-interactive":
+		// Added below together with the second factor of other methods.
+	default:
 		if config.SSHPrivateKey != "" {
 			signer, err := parsePrivateKey(config.SSHPrivateKey, config.SSHKeyPassphrase)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse private key: %w", err)
 			}
-			methods = append(methods, ssh.PublicKeys(signer))
+			if config.SSHCertificate != "" {
+				signer, err = certSigner(config.SSHCertificate, signer, time.Now())
+				if err != nil {
+					return nil, fmt.Errorf("invalid SSH certificate: %w", err)
+				}
+			}
+			auth.methods = append(auth.methods, ssh.PublicKeys(signer))
+		}
+	}
+
+	// Servers requiring several factors, e.g. "publickey,keyboard-interactive",
+	// continue with the next method after a partial success.
+	if config.AuthMethod == "keyboard-interactive" || config.OTPSecret != "" {
+		method, err := keyboardInteractive(config)
+		if err != nil {
+			return nil, err
 		}
+		auth.methods = append(auth.methods, method)
 	}
 
-	if len(methods) == 0 {
+	if len(auth.methods) == 0 {
 		return nil, fmt.Errorf("no authentication method configured")
 	}
 
-	return methods, nil
+	return auth, nil
 }
 
+// parsePrivateKey parses PEM, OpenSSH and PuTTY (PPK v2 and v3) private keys.
 func parsePrivateKey(key, passphrase string) (ssh.Signer, error) {
 	keyBytes := []byte(key)
 
+	if isPPK(keyBytes) {
+		return parsePPK(keyBytes, passphrase)
+	}
+
 	if passphrase != "" {
 		return ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
 	}
@@ -108,33 +295,24 @@ func parsePrivateKey(key, passphrase string) (ssh.Signer, error) {
 
 // TestConnection tests SSH connectivity without creating a tunnel.
 // It connects to the SSH server, authenticates, and immediately closes.
-func TestConnection(config TunnelConfig) error {
-	authMethods, err := buildAuthMethods(config)
-	if err != nil {
-		return fmt.Errorf("failed to build auth methods: %w", err)
-	}
-
-	sshConfig := &ssh.ClientConfig{
-		User:            config.SSHUsername,
-		Auth:            authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         10 * time.Second,
-	}
-
-	addr := fmt.Sprintf("%s:%d", config.SSHHost, config.SSHPort)
-	client, err := ssh.Dial("tcp", addr, sshConfig)
+// The returned ConnectionInfo describes every hop that was attempted, also
+// when the connection failed.
+func TestConnection(ctx context.Context, config TunnelConfig) (*ConnectionInfo, error) {
+	info := &ConnectionInfo{}
+	clients, err := dialChain(ctx, config, 10*time.Second, info)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %w", err)
+		return info, fmt.Errorf("failed to connect: %w", err)
 	}
-	defer client.Close()
+	defer closeChain(clients)
+	client := clients[len(clients)-1]
 
 	// Send a keepalive to verify the connection is fully working
 	_, _, err = client.SendRequest("keepalive@golang.org", true, nil)
 	if err != nil {
-		return fmt.Errorf("connection established but failed keepalive: %w", err)
+		return info, fmt.Errorf("connection established but failed keepalive: %w", err)
 	}
 
-	return nil
+	return info, nil
 }
 
 func (t *Tunnel) acceptLoop() {
@@ -162,10 +340,10 @@ func (t *Tunnel) acceptLoop() {
 func (t *Tunnel) handleConnection(localConn net.Conn) {
 	defer localConn.Close()
 
-	remoteAddr := fmt.Sprintf("%s:%d", t.config.RemoteHost, t.config.RemotePort)
+	_, remoteAddr := t.remote()
 	log.DefaultLogger.Debug("Dialing remote address through SSH tunnel", "remoteAddr", remoteAddr)
 
-	remoteConn, err := t.client.Dial("tcp", remoteAddr)
+	remoteConn, err := t.DialContext(context.Background(), "", "")
 	if err != nil {
 		log.DefaultLogger.Error("Failed to dial remote address through SSH tunnel", "remoteAddr", remoteAddr, "error", err)
 		return
@@ -196,50 +374,166 @@ func (t *Tunnel) handleConnection(localConn net.Conn) {
 	wg.Wait()
 }
 
+// Target is a service on the SSH server's side of the tunnel.
+type Target struct {
+	Host string
+	Port int
+	// Socket is a Unix socket path used instead of Host and Port.
+	Socket string
+}
+
+// remote returns the network and address of the target.
+func (t Target) remote() (string, string) {
+	if t.Socket != "" {
+		return "unix", t.Socket
+	}
+	return "tcp", net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+}
 
+// target returns the named forward target; the empty name is the one given
+// by RemoteHost, RemotePort and RemoteSocket.
+func (t *Tunnel) target(name string) (Target, error) {
+	if name == "" {
+		return Target{Host: t.config.RemoteHost, Port: t.config.RemotePort, Socket: t.config.RemoteSocket}, nil
+	}
+	target, ok := t.config.Targets[name]
+	if !ok {
+		return Target{}, fmt.Errorf("unknown forward target %q", name)
+	}
+	return target, nil
+}
+
+// remote returns the network and address of the default forward target on
+// the SSH server.
+func (t *Tunnel) remote() (string, string) {
+	target, _ := t.target("")
+	return target.remote()
+}
+
+// DialContext opens a direct-tcpip channel, or a direct-streamlocal channel
+// for Unix socket targets, to the remote target over the SSH connection. The
+// network and address arguments are ignored, so it can be used as
+// http.Transport.DialContext for requests to the remote target's URL.
+func (t *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return t.DialTarget(ctx, "")
+}
+
+// DialTarget opens a connection to the named forward target, see
+// TunnelConfig.Targets, using the configured transport. The empty name dials
+// the default target.
+func (t *Tunnel) DialTarget(ctx context.Context, name string) (net.Conn, error) {
+	target, err := t.target(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Ready(); err != nil {
+		dialFailures.WithLabelValues(t.config.DatasourceUID, dialFailureReason(err)).Inc()
+		return nil, err
+	}
+	t.touch()
+	client, _ := t.currentClient()
+	conn, err := t.dialRemote(ctx, client, target)
+	if err != nil {
+		dialFailures.WithLabelValues(t.config.DatasourceUID, dialFailureReason(err)).Inc()
+		return nil, err
+	}
+	tracked := t.channels.add(newMeteredConn(conn, t.config.DatasourceUID, t.touch))
+	if tracked == nil {
+		conn.Close()
+		return nil, fmt.Errorf("SSH tunnel closed")
+	}
+	return tracked, nil
+}
+
+// Endpoint returns the address of the SSH host endpoint currently in use.
+func (t *Tunnel) Endpoint() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.endpoint.addr()
+}
+
+// Hops describes the hops of the current SSH connection, including the host
+// key each server presented, or nil while reconnecting.
+func (t *Tunnel) Hops() []HopInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.lease == nil {
+		return nil
+	}
+	return t.lease.Hops()
+}
+
+// LocalAddr returns the address of the local listener, or an empty string
+// when the tunnel was created without one.
 func (t *Tunnel) LocalAddr() string {
 	return t.localAddr
 }
 
+// IsAlive reports whether the tunnel has not been closed. A lost connection
+// is re-established by the supervisor, see Ready.
 func (t *Tunnel) IsAlive() bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
+	return t.alive
+}
+
+// Ready returns nil when the tunnel can carry traffic. While the supervisor
+// reconnects it fails fast with ErrTunnelReconnecting instead of blocking.
+func (t *Tunnel) Ready() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
 	if !t.alive {
-		return false
+		return fmt.Errorf("SSH tunnel closed")
 	}
-
-	_, _, err := t.client.SendRequest("keepalive@golang.org", true, nil)
-	return err == nil
+	if !t.connected {
+		if t.lastErr != nil {
+			return fmt.Errorf("%w: %v", ErrTunnelReconnecting, t.lastErr)
+		}
+		return ErrTunnelReconnecting
+	}
+	return nil
 }
 
+// Close stops accepting connections, waits up to the configured drain timeout
+// for open connections to the remote target to finish and closes the ones
+// that are left before releasing the SSH connection.
 func (t *Tunnel) Close() error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	return t.close(t.config.DrainTimeout)
+}
 
+func (t *Tunnel) close(grace time.Duration) error {
+	t.mu.Lock()
 	if !t.alive {
+		t.mu.Unlock()
 		return nil
 	}
 
 	t.alive = false
 	close(t.done)
 
-	var errs []error
-
+	var err error
 	if t.listener != nil {
-		if err := t.listener.Close(); err != nil {
-			errs = append(errs, err)
-		}
+		err = t.listener.Close()
 	}
+	t.mu.Unlock()
 
-	if t.client != nil {
-		if err := t.client.Close(); err != nil {
-			errs = append(errs, err)
-		}
+	// Not under t.mu, which the collector takes while scraping.
+	liveTunnels.remove(t)
+
+	open, forced := t.channels.drain(grace)
+	if grace > 0 && forced > 0 {
+		log.DefaultLogger.Warn("SSH tunnel drain timed out, closed active connections", "host", t.Endpoint(), "open", open, "forced", forced, "gracePeriod", grace)
+	} else if grace > 0 && open > 0 {
+		log.DefaultLogger.Info("SSH tunnel drained", "host", t.Endpoint(), "connections", open)
 	}
 
-	if len(errs) > 0 {
-		return errs[0]
+	// The SSH connection is shared and closed by the pool once unused.
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lease != nil {
+		t.lease.Release()
 	}
-	return nil
+
+	return err
 }
@@ -1,6 +1,11 @@
 import { DataQuery, DataSourceJsonData } from '@grafana/data';
 
-export type AuthMethod = 'password' | 'key';
+export type AuthMethod = 'password' | 'key' | 'agent' | 'ca' | 'keyboard-interactive';
+export type SSHHostStrategy = 'failover' | 'random' | 'latency';
+export type ProxyType = 'socks5' | 'http';
+export type HostKeyPolicy = 'tofu' | 'known_hosts' | 'fingerprint' | 'insecure';
+export type SSHAlgorithmPreset = 'modern' | 'fips' | 'legacy';
+export type TunnelTransport = 'auto' | 'forward' | 'exec';
 export type PrometheusAuthMethod = 'none' | 'basic' | 'bearer';
 
 export interface SSHPrometheusQuery extends DataQuery {
@@ -10,6 +15,8 @@ export interface SSHPrometheusQuery extends DataQuery {
   range?: boolean;
   interval?: string;
   format?: 'time_series' | 'table' | 'heatmap';
+  exemplar?: boolean;
+  histogramFormat?: 'buckets' | 'count_sum';
 }
 
 export const defaultQuery: Partial<SSHPrometheusQuery> = {
@@ -19,12 +26,83 @@ export const defaultQuery: Partial<SSHPrometheusQuery> = {
   range: true,
 };
 
+export interface JumpHost {
+  host: string;
+  port?: number;
+  username: string;
+  authMethod: AuthMethod;
+  agentSocket?: string;
+  hostKeyPolicy?: HostKeyPolicy;
+  hostKeyFingerprint?: string;
+}
+
+export interface ForwardTarget {
+  name: string;
+  url: string;
+}
+
 export interface SSHPrometheusDataSourceOptions extends DataSourceJsonData {
   // SSH Connection
   sshHost: string;
   sshPort: number;
   sshUsername: string;
   authMethod: AuthMethod;
+  agentSocket?: string;
+  sshCertExpiryWarningHours?: number;
+
+  // Expose Prometheus on a local 127.0.0.1 port (opt-in)
+  localListener?: boolean;
+
+  // Port forwarding or a relay command in an exec session
+  transport?: TunnelTransport;
+  execCommand?: string;
+
+  // SSH keepalive supervisor
+  keepaliveInterval?: number;
+  keepaliveMaxMisses?: number;
+
+  // Seconds without traffic before the tunnel is closed (0: never)
+  idleTimeout?: number;
+
+  // Seconds in-flight requests get to finish when the datasource is disposed (default: 10, negative: none)
+  drainTimeout?: number;
+
+  // Regular expressions recognising keyboard-interactive prompts
+  passwordPromptPattern?: string;
+  otpPromptPattern?: string;
+
+  // Certificates minted by the built-in SSH CA (authMethod 'ca')
+  caCertTtl?: number;
+  caCertPrincipals?: string[];
+  caCertCriticalOptions?: Record<string, string>;
+  caCertExtensions?: string[];
+
+  // Alternative SSH host endpoints ("host" or "host:port")
+  sshHosts?: string[];
+  sshHostStrategy?: SSHHostStrategy;
+  sshHostCooldown?: number;
+
+  // SSH Host Key Verification
+  hostKeyPolicy?: HostKeyPolicy;
+  hostKeyFingerprint?: string;
+
+  // SSH algorithm policy; non-empty lists override the preset
+  sshAlgorithmPreset?: SSHAlgorithmPreset;
+  sshKeyExchanges?: string[];
+  sshCiphers?: string[];
+  sshMacs?: string[];
+  sshHostKeyAlgorithms?: string[];
+
+  // SOCKS5 or HTTP CONNECT proxy used to reach the first SSH hop
+  proxyType?: ProxyType;
+  proxyAddress?: string;
+  proxyUsername?: string;
+
+  // Jump hosts dialed in order before sshHost (ProxyJump)
+  jumpHosts?: JumpHost[];
+
+  // Further services behind the SSH host, e.g. Alertmanager
+  targets?: ForwardTarget[];
 
   // Prometheus Connection
   prometheusUrl: string;
@@ -44,6 +122,9 @@ export interface SSHPrometheusDataSourceOptions extends DataSourceJsonData {
 
   // Timeouts
   timeout?: number;
+
+  // Maximum Prometheus response size in megabytes, 0 is unlimited
+  maxResponseSize?: number;
 }
 
 export interface SSHPrometheusSecureJsonData {
@@ -51,6 +132,17 @@ export interface SSHPrometheusSecureJsonData {
   sshPassword?: string;
   sshPrivateKey?: string;
   sshKeyPassphrase?: string;
+  sshKnownHosts?: string;
+  sshCertificate?: string;
+  sshOTPSecret?: string;
+  proxyPassword?: string;
+  sshCAPrivateKey?: string;
+  sshCAKeyPassphrase?: string;
+
+  // Jump host secrets are keyed by position, e.g. jumpHost0Password,
+  // jumpHost0PrivateKey, jumpHost0KeyPassphrase, jumpHost0Certificate,
+  // jumpHost0OTPSecret and jumpHost0KnownHosts
+  [jumpHostSecret: `jumpHost${number}${string}`]: string | undefined;
 
   // Prometheus secrets
   prometheusPassword?: string;